@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum uploads listed by the admin console.
+const adminMaxUploads = 500
+
+var categoryRe = regexp.MustCompile(`^[a-z0-9.\-]{1,32}$`)
+
+var errNoSuchJob = errors.New("no such job")
+
+type maintenanceJob struct {
+	Name        string
+	Description string
+	Run         func(ctx *context) (string, error)
+}
+
+type jobStatus struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Running     bool      `json:"running"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error"`
+}
+
+// jobRunner runs maintenance jobs in the background, one of each at a time.
+type jobRunner struct {
+	sync.Mutex
+	jobs   []maintenanceJob
+	status map[string]*jobStatus
+}
+
+func newJobRunner() *jobRunner {
+	r := &jobRunner{
+		jobs:   maintenanceJobs,
+		status: make(map[string]*jobStatus),
+	}
+	for _, j := range r.jobs {
+		r.status[j.Name] = &jobStatus{Name: j.Name, Description: j.Description}
+	}
+	return r
+}
+
+var maintenanceJobs = []maintenanceJob{
+	{"blacklist", "Reload the blacklist.", func(ctx *context) (string, error) {
+		if err := ctx.Blacklist.load(ctx); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d entries", len(ctx.Blacklist.list())), nil
+	}},
+	{"keys", "Reload the api keys file.", func(ctx *context) (string, error) {
+		if keysFile == "" {
+			return "", errors.New("no keys file configured")
+		}
+		n, err := ctx.Keys.load(keysFile)
+		return fmt.Sprintf("%d keys", n), err
+	}},
+	{"titles", "Reimport the anime titles.", func(ctx *context) (string, error) {
+		if titlesFile == "" {
+			return "", errors.New("no titles file configured")
+		}
+		n, err := ctx.Titles.importTitles(titlesFile)
+		return fmt.Sprintf("%d anime", n), err
+	}},
+	{"fingerprint", "Fingerprint a batch of new uploads.", func(ctx *context) (string, error) {
+		ids, err := unfingerprintedUploads(ctx)
+		if err != nil {
+			return "", err
+		}
+		failed := 0
+		for _, id := range ids {
+			if watchFingerprint(ctx, id) != nil {
+				failed++
+			}
+		}
+		return fmt.Sprintf("%d uploads, %d failed", len(ids), failed), nil
+	}},
+	{"screen", "Screen a batch of new uploads.", func(ctx *context) (string, error) {
+		uploads, err := unscreenedUploads(ctx)
+		if err != nil {
+			return "", err
+		}
+		failed := 0
+		for id, u := range uploads {
+			if screenUpload(ctx, id, u) != nil {
+				failed++
+			}
+		}
+		return fmt.Sprintf("%d uploads, %d failed", len(uploads), failed), nil
+	}},
+	{"availability", "Check a batch of uploads against the NNTP server.", func(ctx *context) (string, error) {
+		if ctx.Nntp == nil {
+			return "", errors.New("no NNTP server configured")
+		}
+		ids, err := uncheckedUploads(ctx, time.Now().Add(-recheckAfter))
+		if err != nil {
+			return "", err
+		}
+		failed := 0
+		for _, id := range ids {
+			if watchCheck(ctx, id) != nil {
+				failed++
+			}
+		}
+		return fmt.Sprintf("%d uploads, %d failed", len(ids), failed), nil
+	}},
+	{"searches", "Run every saved search now.", func(ctx *context) (string, error) {
+		searches, err := listSavedSearches(ctx, "")
+		if err != nil {
+			return "", err
+		}
+		for i := range searches {
+			runSavedSearch(ctx, &searches[i])
+		}
+		return fmt.Sprintf("%d searches", len(searches)), nil
+	}},
+	{"escache", "Clear the ElasticSearch caches of the nzb index.", func(ctx *context) (string, error) {
+		return "cleared", esRequest(ctx, "POST", "/nzb/_cache/clear", nil, nil)
+	}},
+}
+
+// start runs the named job unless it is already running.
+func (r *jobRunner) start(ctx *context, name string) (*jobStatus, error) {
+	var job *maintenanceJob
+	for i := range r.jobs {
+		if r.jobs[i].Name == name {
+			job = &r.jobs[i]
+		}
+	}
+	if job == nil {
+		return nil, errNoSuchJob
+	}
+	r.Lock()
+	defer r.Unlock()
+	st := r.status[name]
+	if st.Running {
+		return nil, errors.New("job is already running")
+	}
+	st.Running = true
+	st.Started = time.Now().UTC()
+	go func() {
+		result, err := runJob(ctx, job)
+		r.Lock()
+		st.Running = false
+		st.Finished = time.Now().UTC()
+		st.Result = result
+		st.Error = ""
+		if err != nil {
+			st.Error = err.Error()
+		}
+		r.Unlock()
+	}()
+	s := *st
+	return &s, nil
+}
+
+func runJob(ctx *context, job *maintenanceJob) (result string, err error) {
+	defer func() {
+		// Most of what jobs call panics on failure.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func (r *jobRunner) list() []jobStatus {
+	r.Lock()
+	defer r.Unlock()
+	jobs := make([]jobStatus, len(r.jobs))
+	for idx, j := range r.jobs {
+		jobs[idx] = *r.status[j.Name]
+	}
+	return jobs
+}
+
+// adminConsole serves the admin page. It holds no data, everything is
+// fetched from the admin api with the admin's key.
+func adminConsole(ctx *context, res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/html")
+	renderTemplate(res, "admin.html", struct {
+		Base string
+	}{ctx.urls(req).Prefix})
+}
+
+type adminStatus struct {
+	Cluster   interface{}       `json:"cluster"`
+	Indices   map[string]int64  `json:"indices"`
+	Blacklist int               `json:"blacklist"`
+	Titles    int               `json:"titles"`
+	Keys      int               `json:"keys"`
+	Nntp      bool              `json:"nntp"`
+	Workers   map[string]string `json:"workers"`
+}
+
+// getAdminStatus reports the health of the ElasticSearch cluster and the
+// state of animezb itself.
+func getAdminStatus(ctx *context, res http.ResponseWriter) {
+	st := adminStatus{
+		Indices:   make(map[string]int64),
+		Blacklist: len(ctx.Blacklist.list()),
+		Titles:    ctx.Titles.size(),
+		Keys:      len(ctx.Keys.usageReport()),
+		Nntp:      ctx.Nntp != nil,
+		Workers: map[string]string{
+			"searches":     watchInterval.String(),
+			"dedupe":       dedupeInterval.String(),
+			"availability": checkInterval.String(),
+		},
+	}
+	var health map[string]interface{}
+	if err := esRequest(ctx, "GET", "/_cluster/health", nil, &health); err != nil {
+		st.Cluster = map[string]string{"error": err.Error()}
+	} else {
+		st.Cluster = health
+	}
+	for _, path := range []string{"/nzb/upload", "/nzb/file", "/nzb/segment", dataPath(ctx, "savedsearch")} {
+		var count struct {
+			Count int64 `json:"count"`
+		}
+		if err := esRequest(ctx, "GET", path+"/_count", nil, &count); err == nil {
+			st.Indices[strings.TrimPrefix(path, "/")] = count.Count
+		} else {
+			st.Indices[strings.TrimPrefix(path, "/")] = -1
+		}
+	}
+	writeJson(res, 200, st)
+}
+
+type adminUpload struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Poster     string `json:"poster"`
+	Groups     string `json:"groups"`
+	Size       string `json:"size"`
+	Completion string `json:"completion"`
+	Age        string `json:"age"`
+	Category   string `json:"category"`
+	Hidden     bool   `json:"hidden"`
+}
+
+// listRecentUploads lists the newest uploads, hidden ones included.
+func listRecentUploads(ctx *context, res http.ResponseWriter, req *http.Request) {
+	size := 100
+	if n, err := strconv.Atoi(req.FormValue("size")); err == nil && n > 0 && n <= adminMaxUploads {
+		size = n
+	}
+	q := req.FormValue("q")
+	if q == "" {
+		q = "*"
+	}
+	page, err := searchBackend(ctx, searchOptions{
+		Query:      q,
+		Length:     size,
+		ShowHidden: true,
+	})
+	if err != nil {
+		jsonError(res, 400, err.Error())
+		return
+	}
+	uploads := make([]adminUpload, 0, len(page.Results))
+	for _, r := range page.Results {
+		if r.UploadId == "" {
+			continue
+		}
+		uploads = append(uploads, adminUpload{
+			Id:         r.UploadId,
+			Name:       r.Name,
+			Poster:     r.Poster,
+			Groups:     r.FullGroup,
+			Size:       r.Size,
+			Completion: r.Completion,
+			Age:        r.Age,
+			Category:   r.Category,
+			Hidden:     r.Hidden,
+		})
+	}
+	writeJson(res, 200, uploads)
+}
+
+type ingestRate struct {
+	Group    string  `json:"group"`
+	LastHour int64   `json:"lasthour"`
+	LastDay  int64   `json:"lastday"`
+	PerHour  float64 `json:"perhour"`
+}
+
+// getIngestRates counts the uploads indexed per newsgroup over the last
+// hour and day.
+func getIngestRates(ctx *context, res http.ResponseWriter) {
+	now := time.Now()
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"filter": map[string]interface{}{
+			"range": map[string]interface{}{
+				"date": map[string]interface{}{
+					"gte": now.Add(-24 * time.Hour).Format(time.RFC3339),
+				},
+			},
+		},
+		"aggs": map[string]interface{}{
+			"groups": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": "group",
+					"size":  100,
+				},
+				"aggs": map[string]interface{}{
+					"lasthour": map[string]interface{}{
+						"filter": map[string]interface{}{
+							"range": map[string]interface{}{
+								"date": map[string]interface{}{
+									"gte": now.Add(-time.Hour).Format(time.RFC3339),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"size": 0,
+	}
+	var esResp struct {
+		Aggregations struct {
+			Groups struct {
+				Buckets []struct {
+					Key      string `json:"key"`
+					Count    int64  `json:"doc_count"`
+					LastHour struct {
+						Count int64 `json:"doc_count"`
+					} `json:"lasthour"`
+				} `json:"buckets"`
+			} `json:"groups"`
+		} `json:"aggregations"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		panic(err)
+	}
+	rates := make([]ingestRate, 0, len(esResp.Aggregations.Groups.Buckets))
+	for _, b := range esResp.Aggregations.Groups.Buckets {
+		rates = append(rates, ingestRate{
+			Group:    b.Key,
+			LastHour: b.LastHour.Count,
+			LastDay:  b.Count,
+			PerHour:  float64(b.Count) / 24,
+		})
+	}
+	writeJson(res, 200, rates)
+}
+
+// updateUpload hides or unhides an upload, with hidden=1 or 0, and
+// overrides its category, with category, an empty one restoring the
+// default. Changes are recorded in the audit log.
+func updateUpload(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	uploadId := params["nzbid"]
+	if _, err := getUpload(ctx, uploadId); err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such upload")
+			return
+		}
+		panic(err)
+	}
+	req.ParseForm()
+	doc := make(map[string]interface{})
+	entry := blacklistEntry{Type: BLACKLIST_UPLOAD, Value: uploadId}
+	actions := make([]string, 0, 2)
+	switch req.Form.Get("hidden") {
+	case "":
+	case "1":
+		doc["hidden"] = true
+		actions = append(actions, "hide")
+	case "0":
+		doc["hidden"] = false
+		actions = append(actions, "unhide")
+	default:
+		jsonError(res, 400, "hidden must be 0 or 1")
+		return
+	}
+	if _, ok := req.Form["category"]; ok {
+		category := strings.ToLower(strings.TrimSpace(req.Form.Get("category")))
+		if category != "" && !categoryRe.MatchString(category) {
+			jsonError(res, 400, "invalid category")
+			return
+		}
+		doc["category"] = category
+		actions = append(actions, "category:"+category)
+	}
+	if len(doc) == 0 {
+		jsonError(res, 400, "nothing to update")
+		return
+	}
+	update := map[string]interface{}{
+		"doc": doc,
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/"+uploadId+"/_update?refresh=true", update, nil); err != nil {
+		panic(err)
+	}
+	for _, action := range actions {
+		logAudit(ctx, action, entry, user, req.Form.Get("reason"))
+	}
+	upload, err := getUpload(ctx, uploadId)
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := doc["hidden"]; ok {
+		repickAlternatives(ctx, uploadId)
+	}
+	writeJson(res, 200, map[string]interface{}{
+		"id":       uploadId,
+		"hidden":   upload.Hidden,
+		"category": upload.Category,
+	})
+}
+
+func listKeyUsage(ctx *context, res http.ResponseWriter) {
+	writeJson(res, 200, ctx.Keys.usageReport())
+}
+
+func listJobs(ctx *context, res http.ResponseWriter) {
+	writeJson(res, 200, ctx.Jobs.list())
+}
+
+func startJob(ctx *context, params martini.Params, res http.ResponseWriter) {
+	st, err := ctx.Jobs.start(ctx, params["name"])
+	if err != nil {
+		if err == errNoSuchJob {
+			jsonError(res, 404, err.Error())
+		} else {
+			jsonError(res, 409, err.Error())
+		}
+		return
+	}
+	writeJson(res, 202, st)
+}
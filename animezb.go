@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/codegangsta/martini"
@@ -12,10 +13,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -23,12 +26,58 @@ var httpport int
 var htmldir string
 var elasticsearch string
 var useGzip bool
+var titlesFile string
+var keysFile string
+var dataIndex string
+var publicUrl string
+var watchInterval time.Duration
+var nntpCfg nntpConfig
+var checkInterval time.Duration
+var recheckAfter time.Duration
+var minAvailability float64
+var dedupeInterval time.Duration
+var rateLimitsFile string
+var trustedProxyList string
+var tlsCert string
+var tlsKey string
+var tlsPort int
+var tlsMinVersion string
+var httpsRedirect bool
+var rssMaxItems int
+var statsInterval time.Duration
 
 type HasBytes interface {
 	Bytes() []byte
 }
 
-func initMartini() (*martini.ClassicMartini, error) {
+func writeJson(res http.ResponseWriter, status int, v interface{}) {
+	if output, err := json.Marshal(v); err == nil {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		res.Write(output)
+	} else {
+		panic(err)
+	}
+}
+
+func jsonError(res http.ResponseWriter, status int, message string) {
+	writeJson(res, status, map[string]string{"error": message})
+}
+
+// renderTemplate executes the named template from the html directory.
+func renderTemplate(res http.ResponseWriter, name string, data interface{}) {
+	t, err := template.New(name).ParseFiles(filepath.Join(htmldir, name))
+	if err == nil {
+		res.WriteHeader(200)
+		if err := t.Execute(res, data); err != nil {
+			panic(err)
+		}
+	} else {
+		panic(err)
+	}
+}
+
+func initMartini() (http.Handler, error) {
 	m := martini.Classic()
 	if useGzip {
 		m.Use(gzip.All())
@@ -126,14 +175,89 @@ func initMartini() (*martini.ClassicMartini, error) {
 		}
 	}
 
+	proxies, err := parseTrustedProxies(trustedProxyList)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx := &context{
-		EsConn:  goes.NewConnection(eshost, esport),
-		EsHost:  eshost,
-		EsPort:  esport,
-		HtmlDir: http.Dir(htmldir),
+		EsConn:    goes.NewConnection(eshost, esport),
+		EsHost:    eshost,
+		EsPort:    esport,
+		HtmlDir:   http.Dir(htmldir),
+		Titles:    newTitleIndex(),
+		Keys:      newApiKeys(),
+		Blacklist: newBlacklist(),
+		Jobs:      newJobRunner(),
+		Limits:    newRateLimiter(),
+		Stats:     &statsCache{},
+		Proxies:   proxies,
+
+		DataIndex: dataIndex,
+	}
+	if publicUrl != "" {
+		if ctx.Urls, err = parsePublicUrl(publicUrl); err != nil {
+			return nil, err
+		}
+	} else {
+		ctx.Urls = &urlBuilder{Scheme: "http", Host: fmt.Sprintf("localhost:%d", httpport)}
+	}
+
+	if titlesFile != "" {
+		if n, err := ctx.Titles.importTitles(titlesFile); err == nil {
+			log.Printf("Imported %d anime titles from %s", n, titlesFile)
+		} else {
+			return nil, err
+		}
 	}
 
+	if keysFile != "" {
+		if n, err := ctx.Keys.load(keysFile); err == nil {
+			log.Printf("Loaded %d api keys from %s", n, keysFile)
+		} else {
+			return nil, err
+		}
+	}
+
+	if rateLimitsFile != "" {
+		if n, err := ctx.Limits.load(rateLimitsFile); err == nil {
+			log.Printf("Loaded %d rate limits from %s", n, rateLimitsFile)
+		} else {
+			return nil, err
+		}
+	}
+	go sweepRateLimits(ctx.Limits, 10*time.Minute)
+
 	m.Map(ctx)
+	if tlsCert != "" && httpsRedirect {
+		m.Use(redirectToHttps)
+	}
+
+	if err := ctx.Blacklist.load(ctx); err != nil {
+		log.Printf("Failed to load blacklist, retrying in the background: %s", err)
+	}
+	go refreshBlacklist(ctx, time.Minute)
+	go watchScreening(ctx, time.Minute)
+
+	if nntpCfg.Addr != "" {
+		ctx.Nntp = newNntpPool(nntpCfg)
+	}
+
+	if watchInterval > 0 {
+		if !ctx.Urls.configured {
+			log.Printf("No -url set, saved search webhooks will link to %s", ctx.Urls.Abs("/"))
+		}
+		go watchSavedSearches(ctx, watchInterval)
+	}
+	if dedupeInterval > 0 {
+		go watchDuplicates(ctx, dedupeInterval)
+	}
+	if ctx.Nntp != nil && checkInterval > 0 {
+		go watchAvailability(ctx, checkInterval, recheckAfter)
+	}
+	if statsInterval > 0 {
+		go refreshStats(ctx, statsInterval)
+	}
 
 	routes(m)
 
@@ -141,7 +265,7 @@ func initMartini() (*martini.ClassicMartini, error) {
 		return 404, "{\"error\":\"404\"}"
 	})
 
-	return m, nil
+	return mountAt(ctx.Urls.Prefix, m), nil
 }
 
 func main() {
@@ -151,6 +275,29 @@ func main() {
 	flag.BoolVar(&useGzip, "gz", false, "Gzip Compression")
 	flag.StringVar(&htmldir, "d", "./www", "Server html directory.")
 	flag.StringVar(&elasticsearch, "es", "localhost:9200", "ElasticSearch server host & port.")
+	flag.StringVar(&titlesFile, "titles", "", "AniDB anime titles dump (xml or dat, optionally gzipped).")
+	flag.StringVar(&keysFile, "keys", "", "API keys file, one \"key name [tier] [admin]\" per line.")
+	flag.StringVar(&dataIndex, "index", "animezb", "ElasticSearch index for saved searches and other animezb data.")
+	flag.StringVar(&publicUrl, "url", "", "Public url of the site, such as https://animezb.com/prefix. Routes are served under its path. Links are made from the request if not set, and saved search webhooks link to localhost.")
+	flag.DurationVar(&watchInterval, "watch", 5*time.Minute, "Saved search interval, 0 to disable.")
+	flag.StringVar(&nntpCfg.Addr, "nntp", "", "NNTP server host:port used to check article availability.")
+	flag.StringVar(&nntpCfg.Username, "nntp-user", "", "NNTP username.")
+	flag.StringVar(&nntpCfg.Password, "nntp-pass", "", "NNTP password.")
+	flag.BoolVar(&nntpCfg.TLS, "nntp-tls", false, "Connect to the NNTP server over TLS.")
+	flag.IntVar(&nntpCfg.MaxConns, "nntp-conns", 8, "Maximum NNTP connections.")
+	flag.DurationVar(&checkInterval, "check", 10*time.Minute, "Availability check interval, 0 to disable.")
+	flag.DurationVar(&recheckAfter, "recheck", 7*24*time.Hour, "Recheck the availability of uploads after this long.")
+	flag.DurationVar(&dedupeInterval, "dedupe", time.Minute, "Interval to fingerprint new uploads for duplicate detection, 0 to disable.")
+	flag.Float64Var(&minAvailability, "minavail", 0, "Default minimum availability, in percent, of search and rss results.")
+	flag.StringVar(&rateLimitsFile, "ratelimits", "", "Rate limits file, one \"tier search|rss|nzb|* rate [burst]\" per line.")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "Comma separated addresses and networks of proxies trusted to set X-Forwarded-For, X-Forwarded-Proto and Forwarded.")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, enables the TLS listener. Reloaded on change or SIGHUP.")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file.")
+	flag.IntVar(&tlsPort, "tls-port", 2334, "TLS server port.")
+	flag.StringVar(&tlsMinVersion, "tls-min", "1.2", "Minimum TLS version, 1.0 to 1.3.")
+	flag.BoolVar(&httpsRedirect, "https-redirect", false, "Redirect plain http requests to the TLS listener.")
+	flag.IntVar(&rssMaxItems, "rss-max", 100, "Maximum items per rss page.")
+	flag.DurationVar(&statsInterval, "stats", 10*time.Minute, "Index statistics refresh interval, 0 to collect them on demand.")
 	flag.Parse()
 
 	log.Print("Starting http server...")
@@ -166,6 +313,28 @@ func main() {
 			}
 			log.Fatal(s.ListenAndServe())
 		}()
+		if tlsCert != "" {
+			certs, err := newCertReloader(tlsCert, tlsKey)
+			if err != nil {
+				log.Fatal("Failed to load TLS certificate. ", err)
+			}
+			tlsConfig, err := newTLSConfig(certs, tlsMinVersion)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go certs.watch(time.Minute)
+			go func() {
+				s := &http.Server{
+					Addr:           fmt.Sprintf(":%d", tlsPort),
+					Handler:        m,
+					TLSConfig:      tlsConfig,
+					ReadTimeout:    5 * time.Minute,
+					WriteTimeout:   5 * time.Minute,
+					MaxHeaderBytes: 1 << 20,
+				}
+				log.Fatal(s.ListenAndServeTLS("", ""))
+			}()
+		}
 	} else {
 		log.Fatal("Failed to start web server.", e)
 	}
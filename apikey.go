@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"github.com/codegangsta/martini"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type apiUser struct {
+	Key   string `json:"-"`
+	Name  string `json:"name"`
+	Tier  string `json:"tier"`
+	Admin bool   `json:"admin"`
+}
+
+type keyUsage struct {
+	Requests int64     `json:"requests"`
+	LastUsed time.Time `json:"lastused"`
+}
+
+type keyUsageEntry struct {
+	apiUser
+	keyUsage
+}
+
+type apiKeys struct {
+	sync.RWMutex
+	keys map[string]*apiUser
+	// Usage since startup, kept across reloads of the keys file.
+	usage map[string]*keyUsage
+}
+
+func newApiKeys() *apiKeys {
+	return &apiKeys{
+		keys:  make(map[string]*apiUser),
+		usage: make(map[string]*keyUsage),
+	}
+}
+
+// load reads API keys from path, one per line:
+//
+//	<key> <name> [tier] [admin]
+//
+// Blank lines and lines starting with # are ignored.
+func (k *apiKeys) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	keys := make(map[string]*apiUser)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		user := &apiUser{Key: fields[0], Name: fields[1], Tier: "default"}
+		if len(fields) > 2 {
+			user.Tier = fields[2]
+		}
+		if len(fields) > 3 && fields[3] == "admin" {
+			user.Admin = true
+		}
+		keys[user.Key] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	k.Lock()
+	k.keys = keys
+	k.Unlock()
+	return len(keys), nil
+}
+
+func (k *apiKeys) get(key string) *apiUser {
+	if key == "" {
+		return nil
+	}
+	k.RLock()
+	defer k.RUnlock()
+	return k.keys[key]
+}
+
+// record counts a request made with the key.
+func (k *apiKeys) record(user *apiUser) {
+	k.Lock()
+	defer k.Unlock()
+	u, ok := k.usage[user.Key]
+	if !ok {
+		u = &keyUsage{}
+		k.usage[user.Key] = u
+	}
+	u.Requests++
+	u.LastUsed = time.Now().UTC()
+}
+
+// usageReport returns the usage of every key, most used first.
+func (k *apiKeys) usageReport() []keyUsageEntry {
+	k.RLock()
+	defer k.RUnlock()
+	entries := make([]keyUsageEntry, 0, len(k.keys))
+	for key, user := range k.keys {
+		e := keyUsageEntry{apiUser: *user}
+		if u, ok := k.usage[key]; ok {
+			e.keyUsage = *u
+		}
+		entries = append(entries, e)
+	}
+	sort.Sort(keyUsageEntries(entries))
+	return entries
+}
+
+type keyUsageEntries []keyUsageEntry
+
+func (s keyUsageEntries) Len() int      { return len(s) }
+func (s keyUsageEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s keyUsageEntries) Less(i, j int) bool {
+	if s[i].Requests != s[j].Requests {
+		return s[i].Requests > s[j].Requests
+	}
+	return s[i].Name < s[j].Name
+}
+
+func requestApiKey(req *http.Request) string {
+	if key := req.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	return req.FormValue("apikey")
+}
+
+// requireApiKey rejects requests without a valid apikey and maps the
+// *apiUser of the key for the handlers that follow.
+func requireApiKey(ctx *context, c martini.Context, res http.ResponseWriter, req *http.Request) (int, string) {
+	user := ctx.Keys.get(requestApiKey(req))
+	if user == nil {
+		res.Header().Set("Content-Type", "application/json")
+		return 401, "{\"error\":\"invalid api key\"}"
+	}
+	ctx.Keys.record(user)
+	c.Map(user)
+	return 0, ""
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/martini"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Uploads checked per pass of the availability watcher.
+const availabilityBatchSize = 20
+
+type availabilityReport struct {
+	UploadId  string `json:"uploadid"`
+	Segments  int    `json:"segments"`
+	Available int    `json:"available"`
+	// Segments the server gave no answer for, even on a fresh connection.
+	Unknown      int       `json:"unknown"`
+	Availability float64   `json:"availability"`
+	Checked      time.Time `json:"checked"`
+}
+
+// checkAvailability STATs every segment of an upload on the configured
+// NNTP server and records the share of segments still available on the
+// upload.
+func checkAvailability(ctx *context, uploadId string) (availabilityReport, error) {
+	report := availabilityReport{UploadId: uploadId}
+	err := statSegments(ctx.Nntp, &report, func(ids chan<- string) {
+		for _, f := range getFiles(ctx, uploadId) {
+			for _, seg := range getSegments(ctx, f.Id) {
+				ids <- seg.MessageId
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Checked = time.Now().UTC()
+	if checked := report.Segments - report.Unknown; checked > 0 {
+		report.Availability = float64(report.Available) / float64(checked)
+	}
+	update := map[string]interface{}{
+		"doc": map[string]interface{}{
+			"availability":        report.Availability,
+			"availabilitychecked": report.Checked,
+		},
+	}
+	err = esRequest(ctx, "POST", "/nzb/upload/"+uploadId+"/_update", update, nil)
+	return report, err
+}
+
+// statSegments STATs the message ids segments sends over the pool's
+// connections and counts them on report. Segments that can't be checked
+// are counted as unknown, and only fail the check if none could be.
+func statSegments(pool *nntpPool, report *availabilityReport, segments func(chan<- string)) error {
+	ids := make(chan string, 256)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < pool.size(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				ok, err := pool.stat(id)
+				mu.Lock()
+				report.Segments++
+				if err != nil {
+					report.Unknown++
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else if ok {
+					report.Available++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	func() {
+		// segments panics when ES fails, the workers still have to stop.
+		defer close(ids)
+		segments(ids)
+	}()
+	wg.Wait()
+	if report.Segments > 0 && report.Unknown == report.Segments {
+		return firstErr
+	}
+	return nil
+}
+
+func checkUploadAvailability(ctx *context, params martini.Params, res http.ResponseWriter) {
+	if ctx.Nntp == nil {
+		jsonError(res, 503, "no nntp server configured")
+		return
+	}
+	report, err := checkAvailability(ctx, params["nzbid"])
+	if err != nil {
+		jsonError(res, 502, err.Error())
+		return
+	}
+	writeJson(res, 200, report)
+}
+
+// uncheckedUploads returns the newest uploads that have never been checked
+// or were last checked before the given time.
+func uncheckedUploads(ctx *context, before time.Time) ([]string, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"filter": map[string]interface{}{
+			"or": []interface{}{
+				map[string]interface{}{
+					"missing": map[string]interface{}{
+						"field": "availabilitychecked",
+					},
+				},
+				map[string]interface{}{
+					"range": map[string]interface{}{
+						"availabilitychecked": map[string]interface{}{
+							"lt": before.Format(time.RFC3339),
+						},
+					},
+				},
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size":    availabilityBatchSize,
+		"_source": false,
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(esResp.Hits.Hits))
+	for idx, hit := range esResp.Hits.Hits {
+		ids[idx] = hit.Id
+	}
+	return ids, nil
+}
+
+// watchAvailability keeps checking uploads against the NNTP server,
+// rechecking each one after recheck has passed.
+func watchAvailability(ctx *context, interval time.Duration, recheck time.Duration) {
+	for {
+		ids, err := uncheckedUploads(ctx, time.Now().Add(-recheck))
+		if err != nil {
+			log.Printf("Failed to find uploads to check: %s", err)
+		}
+		failed := false
+		for _, id := range ids {
+			if err := watchCheck(ctx, id); err != nil {
+				log.Printf("Availability check of %s failed: %s", id, err)
+				failed = true
+			}
+		}
+		// Keep going while there is a backlog, unless the server is acting up.
+		if failed || len(ids) < availabilityBatchSize {
+			time.Sleep(interval)
+		}
+	}
+}
+
+func watchCheck(ctx *context, id string) (err error) {
+	defer func() {
+		// getFiles and getSegments panic on failure.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	_, err = checkAvailability(ctx, id)
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sendIds(ids ...string) func(chan<- string) {
+	return func(c chan<- string) {
+		for _, id := range ids {
+			c <- id
+		}
+	}
+}
+
+func TestStatSegments(t *testing.T) {
+	s := newFakeNntp(t, "a@x", "b@x", "c@x")
+	defer s.Close()
+	s.Broken["<e@x>"] = true
+	var report availabilityReport
+	if err := statSegments(s.pool(2), &report, sendIds("a@x", "b@x", "c@x", "d@x", "e@x")); err != nil {
+		t.Fatal(err)
+	}
+	if report.Segments != 5 || report.Available != 3 || report.Unknown != 1 {
+		t.Errorf("report = %+v, want 5 segments, 3 available, 1 unknown", report)
+	}
+}
+
+func TestStatSegmentsUnreachable(t *testing.T) {
+	s := newFakeNntp(t)
+	s.Close()
+	var report availabilityReport
+	if err := statSegments(s.pool(2), &report, sendIds("a@x", "b@x")); err == nil {
+		t.Errorf("check without a server succeeded: %+v", report)
+	}
+}
+
+func TestCheckAvailabilityEsFailure(t *testing.T) {
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer es.Close()
+	s := newFakeNntp(t)
+	defer s.Close()
+	host, port, _ := net.SplitHostPort(es.Listener.Addr().String())
+	ctx := &context{EsHost: host, Nntp: s.pool(4)}
+	ctx.EsPort, _ = strconv.Atoi(port)
+
+	// The first check leaves the keep-alive connection to ES running.
+	watchCheck(ctx, "upload")
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	if err := watchCheck(ctx, "upload"); err == nil {
+		t.Fatal("check succeeded without files")
+	}
+	// The workers must not be left waiting for segments.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left running", n-before)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/codegangsta/martini"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BLACKLIST_UPLOAD  = "upload"
+	BLACKLIST_POSTER  = "poster"
+	BLACKLIST_SUBJECT = "subject"
+)
+
+type blacklistEntry struct {
+	Id     string    `json:"id"`
+	Type   string    `json:"type"`
+	Value  string    `json:"value"`
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+	Date   time.Time `json:"date"`
+}
+
+type auditEntry struct {
+	Action string         `json:"action"`
+	Entry  blacklistEntry `json:"entry"`
+	By     string         `json:"by"`
+	Reason string         `json:"reason"`
+	Date   time.Time      `json:"date"`
+}
+
+type blacklistMatcher struct {
+	Entry blacklistEntry
+	Match func(string) bool
+}
+
+// blacklist caches the blacklist kept in ElasticSearch so it can be
+// applied to every search, feed and nzb without a lookup.
+type blacklist struct {
+	sync.RWMutex
+	entries  []blacklistEntry
+	uploads  map[string]bool
+	posters  []blacklistMatcher
+	subjects []blacklistMatcher
+	// Identifies the poster and subject entries, so uploads screened
+	// against older ones are screened again.
+	version int64
+}
+
+func newBlacklist() *blacklist {
+	return &blacklist{uploads: make(map[string]bool)}
+}
+
+func compileBlacklistEntry(e blacklistEntry) (func(string) bool, error) {
+	switch e.Type {
+	case BLACKLIST_POSTER:
+		// Same syntax as file patterns, a glob or a /regex/.
+		m, err := newFileMatcher(e.Value)
+		return m, err
+	case BLACKLIST_SUBJECT:
+		re, err := regexp.Compile("(?i)" + e.Value)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case BLACKLIST_UPLOAD:
+		return nil, nil
+	}
+	return nil, errors.New("type must be upload, poster or subject")
+}
+
+// load replaces the cached blacklist with the one in ElasticSearch.
+func (b *blacklist) load(ctx *context) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"size": 100000,
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", dataPath(ctx, "blacklist")+"/_search", query, &esResp); err != nil && !isNotFound(err) {
+		return err
+	}
+	entries := make([]blacklistEntry, 0, len(esResp.Hits.Hits))
+	uploads := make(map[string]bool)
+	var posters, subjects []blacklistMatcher
+	var patterns []string
+	for _, hit := range esResp.Hits.Hits {
+		var e blacklistEntry
+		if err := json.Unmarshal(hit.Source, &e); err != nil {
+			return err
+		}
+		e.Id = hit.Id
+		entries = append(entries, e)
+		m, err := compileBlacklistEntry(e)
+		if err != nil {
+			log.Printf("Ignoring invalid blacklist entry %s: %s", e.Id, err)
+			continue
+		}
+		switch e.Type {
+		case BLACKLIST_UPLOAD:
+			uploads[e.Value] = true
+		case BLACKLIST_POSTER:
+			posters = append(posters, blacklistMatcher{e, m})
+			patterns = append(patterns, e.Type+"\x00"+e.Value)
+		case BLACKLIST_SUBJECT:
+			subjects = append(subjects, blacklistMatcher{e, m})
+			patterns = append(patterns, e.Type+"\x00"+e.Value)
+		}
+	}
+	sort.Strings(patterns)
+	h := fnv.New64a()
+	for _, p := range patterns {
+		h.Write([]byte(p + "\n"))
+	}
+	b.Lock()
+	b.entries = entries
+	b.uploads = uploads
+	b.posters = posters
+	b.subjects = subjects
+	b.version = int64(h.Sum64())
+	b.Unlock()
+	return nil
+}
+
+// blockedIds returns the ids of the uploads blacklisted by id.
+func (b *blacklist) blockedIds() []string {
+	b.RLock()
+	defer b.RUnlock()
+	ids := make([]string, 0, len(b.uploads))
+	for id := range b.uploads {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// blockedId reports whether an upload is blacklisted by id.
+func (b *blacklist) blockedId(uploadId string) bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.uploads[uploadId]
+}
+
+// screen reports whether a poster or subject is blacklisted, and the
+// version of the entries it was checked against.
+func (b *blacklist) screen(poster string, subject string) (bool, int64) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.matches(poster, subject), b.version
+}
+
+// patternVersion identifies the current poster and subject entries.
+func (b *blacklist) patternVersion() int64 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.version
+}
+
+// matches runs the poster and subject entries, with b locked.
+func (b *blacklist) matches(poster string, subject string) bool {
+	for _, m := range b.posters {
+		if m.Match(poster) {
+			return true
+		}
+	}
+	for _, m := range b.subjects {
+		if m.Match(subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// blacklistFilters leave out the uploads blacklisted by id and the ones
+// screened as blacklisted by a poster or subject entry.
+func blacklistFilters(ctx *context) []interface{} {
+	filters := []interface{}{
+		map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"blacklisted": true,
+				},
+			},
+		},
+	}
+	if ids := ctx.Blacklist.blockedIds(); len(ids) > 0 {
+		filters = append(filters, map[string]interface{}{
+			"not": map[string]interface{}{
+				"ids": map[string]interface{}{
+					"values": ids,
+				},
+			},
+		})
+	}
+	return filters
+}
+
+// hasPatterns reports whether there are poster or subject entries, which
+// uploads not screened yet can still match.
+func (b *blacklist) hasPatterns() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.posters) > 0 || len(b.subjects) > 0
+}
+
+// blocked reports whether an upload is blacklisted, by id, poster or
+// subject.
+func (b *blacklist) blocked(uploadId string, poster string, subject string) bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.uploads[uploadId] || b.matches(poster, subject)
+}
+
+// posterBlocked reports whether a poster is blacklisted.
+func (b *blacklist) posterBlocked(poster string) bool {
+	b.RLock()
+	defer b.RUnlock()
+	for _, m := range b.posters {
+		if m.Match(poster) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blacklist) list() []blacklistEntry {
+	b.RLock()
+	defer b.RUnlock()
+	entries := make([]blacklistEntry, len(b.entries))
+	copy(entries, b.entries)
+	return entries
+}
+
+// uploadStatus looks up an upload and returns 410 if it is blacklisted,
+// 404 if an admin hid it and 0 otherwise.
+func uploadStatus(ctx *context, uploadId string) int {
+	if ctx.Blacklist.blockedId(uploadId) {
+		return 410
+	}
+	upload, err := getUpload(ctx, uploadId)
+	if err != nil {
+		return 0
+	}
+	if ctx.Blacklist.blocked(uploadId, upload.Poster, upload.Subject) {
+		return 410
+	}
+	if upload.Hidden {
+		return 404
+	}
+	return 0
+}
+
+// removedUpload returns the first blacklisted or hidden upload of a list,
+// if any, and its uploadStatus.
+func removedUpload(ctx *context, uploads []string) (string, int) {
+	for _, id := range uploads {
+		if status := uploadStatus(ctx, id); status != 0 {
+			return id, status
+		}
+	}
+	return "", 0
+}
+
+// checkBlacklist answers requests for a blacklisted upload with a 410, and
+// for a hidden one with a 404.
+func checkBlacklist(ctx *context, params martini.Params, res http.ResponseWriter) (int, string) {
+	switch uploadStatus(ctx, params["nzbid"]) {
+	case 410:
+		res.Header().Set("Content-Type", "application/json")
+		return 410, "{\"error\":\"this upload has been removed\"}"
+	case 404:
+		res.Header().Set("Content-Type", "application/json")
+		return 404, "{\"error\":\"no such upload\"}"
+	}
+	return 0, ""
+}
+
+// requireAdmin is requireApiKey for keys marked as admin.
+func requireAdmin(ctx *context, c martini.Context, res http.ResponseWriter, req *http.Request) (int, string) {
+	user := ctx.Keys.get(requestApiKey(req))
+	if user == nil {
+		res.Header().Set("Content-Type", "application/json")
+		return 401, "{\"error\":\"invalid api key\"}"
+	}
+	if !user.Admin {
+		res.Header().Set("Content-Type", "application/json")
+		return 403, "{\"error\":\"admin only\"}"
+	}
+	ctx.Keys.record(user)
+	c.Map(user)
+	return 0, ""
+}
+
+func logAudit(ctx *context, action string, e blacklistEntry, user *apiUser, reason string) {
+	a := auditEntry{
+		Action: action,
+		Entry:  e,
+		By:     user.Name,
+		Reason: reason,
+		Date:   time.Now().UTC(),
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "audit"), a, nil); err != nil {
+		log.Printf("Failed to write audit log: %s", err)
+	}
+}
+
+func listBlacklist(ctx *context, res http.ResponseWriter) {
+	writeJson(res, 200, ctx.Blacklist.list())
+}
+
+// addBlacklistEntry blacklists an upload id, poster pattern or subject
+// regex. Every change is recorded in the audit log. Uploads matching a new
+// pattern are flagged by watchScreening.
+func addBlacklistEntry(ctx *context, user *apiUser, res http.ResponseWriter, req *http.Request) {
+	var e blacklistEntry
+	if req.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			jsonError(res, 400, "invalid json: "+err.Error())
+			return
+		}
+	} else {
+		req.ParseForm()
+		e.Type = req.FormValue("type")
+		e.Value = req.FormValue("value")
+		e.Reason = req.FormValue("reason")
+	}
+	if e.Value == "" {
+		jsonError(res, 400, "missing value")
+		return
+	}
+	if _, err := compileBlacklistEntry(e); err != nil {
+		jsonError(res, 400, err.Error())
+		return
+	}
+	if e.Reason == "" {
+		jsonError(res, 400, "missing reason")
+		return
+	}
+	e.Id = ""
+	e.By = user.Name
+	e.Date = time.Now().UTC()
+	var esResp struct {
+		Id string `json:"_id"`
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "blacklist")+"?refresh=true", e, &esResp); err != nil {
+		panic(err)
+	}
+	e.Id = esResp.Id
+	logAudit(ctx, "add", e, user, e.Reason)
+	if err := ctx.Blacklist.load(ctx); err != nil {
+		panic(err)
+	}
+	if e.Type == BLACKLIST_UPLOAD {
+		repickAlternatives(ctx, e.Value)
+	}
+	writeJson(res, 201, e)
+}
+
+func removeBlacklistEntry(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	var esResp struct {
+		Source blacklistEntry `json:"_source"`
+	}
+	if err := esRequest(ctx, "GET", dataPath(ctx, "blacklist")+"/"+params["id"], nil, &esResp); err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such entry")
+			return
+		}
+		panic(err)
+	}
+	if err := esRequest(ctx, "DELETE", dataPath(ctx, "blacklist")+"/"+params["id"]+"?refresh=true", nil, nil); err != nil {
+		panic(err)
+	}
+	e := esResp.Source
+	e.Id = params["id"]
+	logAudit(ctx, "remove", e, user, req.FormValue("reason"))
+	if err := ctx.Blacklist.load(ctx); err != nil {
+		panic(err)
+	}
+	if e.Type == BLACKLIST_UPLOAD {
+		repickAlternatives(ctx, e.Value)
+	}
+	res.WriteHeader(204)
+}
+
+func listAudit(ctx *context, res http.ResponseWriter) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size": 500,
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", dataPath(ctx, "audit")+"/_search", query, &esResp); err != nil && !isNotFound(err) {
+		panic(err)
+	}
+	entries := make([]auditEntry, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		var a auditEntry
+		if json.Unmarshal(hit.Source, &a) == nil {
+			entries = append(entries, a)
+		}
+	}
+	writeJson(res, 200, entries)
+}
+
+// refreshBlacklist reloads the blacklist periodically, picking up changes
+// made through other instances.
+func refreshBlacklist(ctx *context, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := ctx.Blacklist.load(ctx); err != nil {
+			log.Printf("Failed to reload blacklist: %s", err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Weeks of posting activity shown.
+	activityWeeks = 26
+	// Newsgroups listed in upload statistics.
+	statsGroups = 20
+	// Uploads listed on poster and group pages.
+	browseUploads = 50
+)
+
+// uploadStats sums up a set of uploads.
+type uploadStats struct {
+	Uploads    int64            `json:"uploads"`
+	Bytes      int64            `json:"bytes"`
+	Size       string           `json:"size"`
+	Completion string           `json:"completion"`
+	FirstSeen  time.Time        `json:"firstseen"`
+	LastSeen   time.Time        `json:"lastseen"`
+	Groups     []groupCount     `json:"groups"`
+	Activity   []activityBucket `json:"activity"`
+}
+
+type groupCount struct {
+	Group   string `json:"group"`
+	Uploads int64  `json:"uploads"`
+}
+
+// activityBucket counts the uploads posted in a week.
+type activityBucket struct {
+	Week    time.Time `json:"week"`
+	Uploads int64     `json:"uploads"`
+	// Height of the week's bar, relative to the busiest week.
+	Percent int `json:"-"`
+}
+
+// uploadSummary is an upload in a list of uploads.
+type uploadSummary struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	Poster     string    `json:"poster"`
+	Groups     []string  `json:"groups"`
+	Bytes      int64     `json:"bytes"`
+	Size       string    `json:"size"`
+	Completion string    `json:"completion"`
+	Date       time.Time `json:"date"`
+	Age        string    `json:"age"`
+	Details    string    `json:"details"`
+	Nzb        string    `json:"nzb"`
+}
+
+// visibleFilter leaves out hidden and blacklisted uploads.
+func visibleFilter(ctx *context) map[string]interface{} {
+	filters := []interface{}{
+		map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"hidden": true,
+				},
+			},
+		},
+	}
+	filters = append(filters, blacklistFilters(ctx)...)
+	return map[string]interface{}{
+		"and": filters,
+	}
+}
+
+func esTime(ms float64) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+}
+
+// aggregateUploads sums up the visible uploads matching query.
+func aggregateUploads(ctx *context, query map[string]interface{}) uploadStats {
+	now := time.Now()
+	since := now.Add(-activityWeeks * 7 * 24 * time.Hour)
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query":  query,
+				"filter": visibleFilter(ctx),
+			},
+		},
+		"aggs": map[string]interface{}{
+			"bytes": map[string]interface{}{
+				"sum": map[string]interface{}{
+					"field": "size",
+				},
+			},
+			"completion": map[string]interface{}{
+				"avg": map[string]interface{}{
+					"field": "completion",
+				},
+			},
+			"first": map[string]interface{}{
+				"min": map[string]interface{}{
+					"field": "date",
+				},
+			},
+			"last": map[string]interface{}{
+				"max": map[string]interface{}{
+					"field": "date",
+				},
+			},
+			"groups": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": "group",
+					"size":  statsGroups,
+				},
+			},
+			"recent": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"range": map[string]interface{}{
+						"date": map[string]interface{}{
+							"gte": since.Format(time.RFC3339),
+						},
+					},
+				},
+				"aggs": map[string]interface{}{
+					"weeks": map[string]interface{}{
+						"date_histogram": map[string]interface{}{
+							"field":         "date",
+							"interval":      "week",
+							"min_doc_count": 0,
+							"extended_bounds": map[string]interface{}{
+								"min": since.UnixNano() / int64(time.Millisecond),
+								"max": now.UnixNano() / int64(time.Millisecond),
+							},
+						},
+					},
+				},
+			},
+		},
+		"size": 0,
+	}
+	type metric struct {
+		Value *float64 `json:"value"`
+	}
+	var esResp struct {
+		Hits struct {
+			Total int64 `json:"total"`
+		} `json:"hits"`
+		Aggregations struct {
+			Bytes      metric `json:"bytes"`
+			Completion metric `json:"completion"`
+			First      metric `json:"first"`
+			Last       metric `json:"last"`
+			Groups     struct {
+				Buckets []struct {
+					Key   string `json:"key"`
+					Count int64  `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"groups"`
+			Recent struct {
+				Weeks struct {
+					Buckets []struct {
+						Key   float64 `json:"key"`
+						Count int64   `json:"doc_count"`
+					} `json:"buckets"`
+				} `json:"weeks"`
+			} `json:"recent"`
+		} `json:"aggregations"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", body, &esResp); err != nil {
+		panic(err)
+	}
+	aggs := esResp.Aggregations
+	st := uploadStats{
+		Uploads:  esResp.Hits.Total,
+		Groups:   make([]groupCount, 0, len(aggs.Groups.Buckets)),
+		Activity: make([]activityBucket, 0, len(aggs.Recent.Weeks.Buckets)),
+	}
+	if aggs.Bytes.Value != nil {
+		st.Bytes = int64(*aggs.Bytes.Value)
+	}
+	st.Size = ByteSize(st.Bytes).String()
+	if aggs.Completion.Value != nil {
+		st.Completion = fmt.Sprintf("%0.2f%%", *aggs.Completion.Value*100)
+	}
+	if aggs.First.Value != nil {
+		st.FirstSeen = esTime(*aggs.First.Value)
+	}
+	if aggs.Last.Value != nil {
+		st.LastSeen = esTime(*aggs.Last.Value)
+	}
+	for _, b := range aggs.Groups.Buckets {
+		st.Groups = append(st.Groups, groupCount{Group: b.Key, Uploads: b.Count})
+	}
+	var busiest int64
+	for _, b := range aggs.Recent.Weeks.Buckets {
+		st.Activity = append(st.Activity, activityBucket{Week: esTime(b.Key), Uploads: b.Count})
+		if b.Count > busiest {
+			busiest = b.Count
+		}
+	}
+	if busiest > 0 {
+		for i := range st.Activity {
+			st.Activity[i].Percent = int(st.Activity[i].Uploads * 100 / busiest)
+		}
+	}
+	return st
+}
+
+// summarizeUploads lists search results on poster and group pages.
+func summarizeUploads(urls *urlBuilder, results []searchResult) []uploadSummary {
+	uploads := make([]uploadSummary, 0, len(results))
+	for _, r := range results {
+		if r.UploadId == "" {
+			continue
+		}
+		groups := r.Groups
+		if groups == nil {
+			groups = []string{}
+		}
+		uploads = append(uploads, uploadSummary{
+			Id:         r.UploadId,
+			Name:       r.Name,
+			Poster:     r.Poster,
+			Groups:     groups,
+			Bytes:      r.ContentBytes,
+			Size:       r.ContentSize,
+			Completion: r.Completion,
+			Date:       r.Time,
+			Age:        r.Age,
+			Details:    urls.Abs("/upload/" + r.UploadId),
+			Nzb:        nzbUrl(urls, r),
+		})
+	}
+	return uploads
+}
@@ -6,8 +6,19 @@ import (
 )
 
 type context struct {
-	EsConn  *goes.Connection
-	HtmlDir http.Dir
-	EsHost  string
-	EsPort  int
+	EsConn    *goes.Connection
+	HtmlDir   http.Dir
+	EsHost    string
+	EsPort    int
+	Titles    *titleIndex
+	Keys      *apiKeys
+	Nntp      *nntpPool
+	Blacklist *blacklist
+	Jobs      *jobRunner
+	Limits    *rateLimiter
+	Stats     *statsCache
+	Proxies   trustedProxies
+
+	DataIndex string
+	Urls      *urlBuilder
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	// Results reachable by offset, beyond them pages are walked with
+	// cursors. ES gets slower the deeper an offset goes and refuses to go
+	// past its result window at all.
+	maxSearchOffset = 2000
+	// Uploads posted in the same second a cursor may carry.
+	maxCursorSeen = 1000
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// searchCursor marks where a page of results ends, so the next one can
+// start there instead of counting results from the start. Results are
+// sorted newest first, and older results come after a cursor unless it
+// walks back to Newer ones.
+type searchCursor struct {
+	Newer bool      `json:"n,omitempty"`
+	Date  time.Time `json:"d"`
+	// Uploads posted at Date already seen, as several uploads can share
+	// a date.
+	Seen []string `json:"s,omitempty"`
+}
+
+// String encodes the cursor as an opaque token for urls.
+func (c *searchCursor) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursor(token string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c searchCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Date.IsZero() || len(c.Seen) > maxCursorSeen {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// cursorAt returns the cursor of the page past results[i], the first or
+// last of a page of results fetched with from, if it isn't nil.
+func cursorAt(results []searchResult, i int, newer bool, from *searchCursor) *searchCursor {
+	edge := results[i].Time
+	c := &searchCursor{Newer: newer, Date: edge}
+	// Still in the same second, the uploads of earlier pages stay seen.
+	if from != nil && from.Newer == newer && from.Date.Equal(edge) {
+		c.Seen = append(c.Seen, from.Seen...)
+	}
+	for _, sr := range results {
+		if sr.Time.Equal(edge) && len(c.Seen) < maxCursorSeen {
+			c.Seen = append(c.Seen, sr.UploadId)
+		}
+	}
+	return c
+}
+
+// filter limits a search to the results past the cursor.
+func (c *searchCursor) filter() map[string]interface{} {
+	bound := "lte"
+	if c.Newer {
+		bound = "gte"
+	}
+	filter := map[string]interface{}{
+		"range": map[string]interface{}{
+			"date": map[string]interface{}{
+				bound: c.Date.Format(time.RFC3339Nano),
+			},
+		},
+	}
+	if len(c.Seen) == 0 {
+		return filter
+	}
+	return map[string]interface{}{
+		"and": []interface{}{
+			filter,
+			map[string]interface{}{
+				"not": map[string]interface{}{
+					"ids": map[string]interface{}{
+						"values": c.Seen,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Uploads fingerprinted per pass of the dedupe watcher.
+	dedupeBatchSize = 100
+	// Uploads are only fingerprinted once they are done being posted.
+	dedupeSettle = time.Hour
+)
+
+// fileKey identifies a file across reposts: its normalized name, its size
+// rounded to the MiB, which differs a little between posting tools, and
+// the CRC32 from its name or subject if there is one.
+func fileKey(f NzbFile) string {
+	crc := parseRelease(f.Name).Crc32
+	if crc == "" {
+		if m := releaseCrcRe.FindStringSubmatch(f.Subject); m != nil {
+			crc = strings.ToUpper(m[1])
+		}
+	}
+	return normalizeTitle(f.Name) + "|" + strconv.FormatInt(f.Bytes>>20, 10) + "|" + crc
+}
+
+// fingerprint hashes the content files of an upload. Uploads of the same
+// release, regardless of poster, newsgroup or par2 files, share it.
+func fingerprint(files []NzbFile) string {
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		if classifyFile(f.Name) == FILE_CONTENT {
+			keys = append(keys, fileKey(f))
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	h := sha1.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:20]
+}
+
+func setFingerprint(ctx *context, uploadId string) (string, error) {
+	fp := fingerprint(getFiles(ctx, uploadId))
+	if fp == "" {
+		// Nothing to compare, mark it so it isn't picked up again.
+		fp = "none"
+	}
+	update := map[string]interface{}{
+		"doc": map[string]interface{}{
+			"fingerprint": fp,
+			"alternative": false,
+		},
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/"+uploadId+"/_update?refresh=true", update, nil); err != nil {
+		return fp, err
+	}
+	return fp, markAlternatives(ctx, fp)
+}
+
+// markAlternatives picks the upload shown for a fingerprint when search
+// results are collapsed, and marks every other one as an alternative so
+// searches can filter them out and page through releases. The newest
+// complete, visible upload is picked, falling back to the newest one.
+func markAlternatives(ctx *context, fp string) error {
+	if fp == "" || fp == "none" {
+		return nil
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{
+				"fingerprint": fp,
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size":    1000,
+		"_source": []string{"poster", "subject", "completion", "hidden", "alternative"},
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		return err
+	}
+	marked := make([]*bool, len(esResp.Hits.Hits))
+	primary, fallback := -1, -1
+	for idx, hit := range esResp.Hits.Hits {
+		var u struct {
+			uploadDoc
+			Alternative *bool `json:"alternative"`
+		}
+		json.Unmarshal(hit.Source, &u)
+		marked[idx] = u.Alternative
+		if u.Hidden || ctx.Blacklist.blocked(hit.Id, u.Poster, u.Subject) {
+			continue
+		}
+		if fallback < 0 {
+			fallback = idx
+		}
+		if primary < 0 && u.Completion >= .9 {
+			primary = idx
+		}
+	}
+	if primary < 0 {
+		primary = fallback
+	}
+	if primary < 0 {
+		primary = 0
+	}
+	for idx, hit := range esResp.Hits.Hits {
+		alternative := idx != primary
+		if marked[idx] != nil && *marked[idx] == alternative {
+			continue
+		}
+		update := map[string]interface{}{
+			"doc": map[string]interface{}{
+				"alternative": alternative,
+			},
+		}
+		if err := esRequest(ctx, "POST", "/nzb/upload/"+hit.Id+"/_update", update, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDuplicates returns the ids of every visible upload sharing a
+// fingerprint.
+func getDuplicates(ctx *context, fp string) []string {
+	if fp == "" || fp == "none" {
+		return []string{}
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{
+				"fingerprint": fp,
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size":    1000,
+		"_source": []string{"poster", "subject", "hidden"},
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		panic(err)
+	}
+	ids := make([]string, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		var u uploadDoc
+		json.Unmarshal(hit.Source, &u)
+		if !u.Hidden && !ctx.Blacklist.blocked(hit.Id, u.Poster, u.Subject) {
+			ids = append(ids, hit.Id)
+		}
+	}
+	return ids
+}
+
+// countDuplicates returns how many visible uploads share each fingerprint.
+func countDuplicates(ctx *context, fps []string) map[string]int {
+	counts := make(map[string]int, len(fps))
+	if len(fps) == 0 {
+		return counts
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query": map[string]interface{}{
+					"terms": map[string]interface{}{
+						"fingerprint": fps,
+					},
+				},
+				"filter": visibleFilter(ctx),
+			},
+		},
+		"aggs": map[string]interface{}{
+			"fingerprints": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": "fingerprint",
+					"size":  len(fps),
+				},
+			},
+		},
+		"size": 0,
+	}
+	var esResp struct {
+		Aggregations struct {
+			Fingerprints struct {
+				Buckets []struct {
+					Key   string `json:"key"`
+					Count int    `json:"doc_count"`
+				} `json:"buckets"`
+			} `json:"fingerprints"`
+		} `json:"aggregations"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		panic(err)
+	}
+	for _, b := range esResp.Aggregations.Fingerprints.Buckets {
+		counts[b.Key] = b.Count
+	}
+	return counts
+}
+
+// repickAlternatives marks the alternatives of an upload again, after it
+// was hidden or blacklisted.
+func repickAlternatives(ctx *context, uploadId string) {
+	upload, err := getUpload(ctx, uploadId)
+	if err != nil {
+		return
+	}
+	if err := markAlternatives(ctx, upload.Fingerprint); err != nil {
+		log.Printf("Failed to mark the alternatives of %s: %s", uploadId, err)
+	}
+}
+
+// countAlternatives counts the other copies of every result of a
+// collapsed search, which ElasticSearch left out as alternatives.
+func countAlternatives(ctx *context, results []searchResult) {
+	fps := make([]string, 0, len(results))
+	for _, sr := range results {
+		if sr.Fingerprint != "" && sr.Fingerprint != "none" {
+			fps = append(fps, sr.Fingerprint)
+		}
+	}
+	counts := countDuplicates(ctx, fps)
+	for idx := range results {
+		if n := counts[results[idx].Fingerprint]; n > 1 {
+			results[idx].Alternatives = n - 1
+		}
+	}
+}
+
+// bestCopies returns, for every file of an upload, the copy with the most
+// parts among all of the upload's duplicates.
+func bestCopies(ctx *context, uploadId string) []NzbFile {
+	files := getFiles(ctx, uploadId)
+	upload, err := getUpload(ctx, uploadId)
+	if err != nil {
+		panic(err)
+	}
+	best := make(map[string]NzbFile, len(files))
+	order := make([]string, 0, len(files))
+	for _, f := range files {
+		k := fileKey(f)
+		best[k] = f
+		order = append(order, k)
+	}
+	for _, dup := range getDuplicates(ctx, upload.Fingerprint) {
+		if dup == uploadId {
+			continue
+		}
+		for _, f := range getFiles(ctx, dup) {
+			k := fileKey(f)
+			if cur, ok := best[k]; ok && f.Length > 0 && f.Parts*cur.Length > cur.Parts*f.Length {
+				best[k] = f
+			}
+		}
+	}
+	copies := make([]NzbFile, len(order))
+	for idx, k := range order {
+		copies[idx] = best[k]
+	}
+	return copies
+}
+
+type duplicateEntry struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Poster     string `json:"poster"`
+	Groups     string `json:"groups"`
+	Size       string `json:"size"`
+	Completion string `json:"completion"`
+	Age        string `json:"age"`
+}
+
+func getUploadDuplicates(ctx *context, params martini.Params, res http.ResponseWriter) {
+	upload, err := getUpload(ctx, params["nzbid"])
+	if err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such upload")
+			return
+		}
+		panic(err)
+	}
+	fp := upload.Fingerprint
+	if fp == "" {
+		if fp, err = setFingerprint(ctx, params["nzbid"]); err != nil {
+			panic(err)
+		}
+	}
+	dups := make([]duplicateEntry, 0, 8)
+	for _, id := range getDuplicates(ctx, fp) {
+		u, err := getUpload(ctx, id)
+		if err != nil {
+			continue
+		}
+		e := duplicateEntry{
+			Id:         id,
+			Name:       strings.TrimSuffix(u.FilePrefix, "."),
+			Poster:     u.Poster,
+			Groups:     strings.Join(u.Group, ", "),
+			Size:       ByteSize(u.Size).String(),
+			Completion: fmt.Sprintf("%0.2f%%", u.Completion*100),
+			Age:        formatAge(u.Date),
+		}
+		dups = append(dups, e)
+	}
+	writeJson(res, 200, map[string]interface{}{
+		"fingerprint": fp,
+		"uploads":     dups,
+	})
+}
+
+// unfingerprintedUploads returns the newest settled uploads without a
+// fingerprint, or fingerprinted before alternatives were marked.
+func unfingerprintedUploads(ctx *context) ([]string, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"filter": map[string]interface{}{
+			"and": []interface{}{
+				map[string]interface{}{
+					"or": []interface{}{
+						map[string]interface{}{
+							"missing": map[string]interface{}{
+								"field": "fingerprint",
+							},
+						},
+						map[string]interface{}{
+							"missing": map[string]interface{}{
+								"field": "alternative",
+							},
+						},
+					},
+				},
+				map[string]interface{}{
+					"range": map[string]interface{}{
+						"date": map[string]interface{}{
+							"lt": time.Now().Add(-dedupeSettle).Format(time.RFC3339),
+						},
+					},
+				},
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size":    dedupeBatchSize,
+		"_source": false,
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(esResp.Hits.Hits))
+	for idx, hit := range esResp.Hits.Hits {
+		ids[idx] = hit.Id
+	}
+	return ids, nil
+}
+
+// watchDuplicates fingerprints new uploads as they are indexed.
+func watchDuplicates(ctx *context, interval time.Duration) {
+	for {
+		ids, err := unfingerprintedUploads(ctx)
+		if err != nil {
+			log.Printf("Failed to find uploads to fingerprint: %s", err)
+		}
+		failed := false
+		for _, id := range ids {
+			if err := watchFingerprint(ctx, id); err != nil {
+				log.Printf("Fingerprinting %s failed: %s", id, err)
+				failed = true
+			}
+		}
+		if failed || len(ids) < dedupeBatchSize {
+			time.Sleep(interval)
+		}
+	}
+}
+
+func watchFingerprint(ctx *context, id string) (err error) {
+	defer func() {
+		// getFiles panics on failure.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	upload, err := getUpload(ctx, id)
+	if err != nil {
+		return err
+	}
+	if upload.Fingerprint == "" || upload.Fingerprint == "none" {
+		_, err = setFingerprint(ctx, id)
+		return err
+	}
+	return markAlternatives(ctx, upload.Fingerprint)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DOWNLOADER_SABNZBD = "sabnzbd"
+	DOWNLOADER_NZBGET  = "nzbget"
+)
+
+var (
+	downloaderClient = newOutboundClient(30*time.Second, false)
+	// For admins, whose downloaders may run on internal hosts.
+	adminDownloaderClient = newOutboundClient(30*time.Second, true)
+)
+
+// downloaderProfile is a SABnzbd or NZBGet instance nzbs can be sent to.
+type downloaderProfile struct {
+	Id       string `json:"id"`
+	ApiKey   string `json:"apikey"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Url      string `json:"url"`
+	Key      string `json:"key,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+type sendResult struct {
+	Ok         bool   `json:"ok"`
+	Downloader string `json:"downloader"`
+	Name       string `json:"name"`
+	Files      int    `json:"files"`
+	Id         string `json:"id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// public hides the downloader credentials from API responses.
+func (p downloaderProfile) public() downloaderProfile {
+	if p.Key != "" {
+		p.Key = "********"
+	}
+	if p.Password != "" {
+		p.Password = "********"
+	}
+	return p
+}
+
+func listDownloaderProfiles(ctx *context, apikey string) ([]downloaderProfile, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": map[string]interface{}{
+				"apikey": map[string]interface{}{
+					"query":    apikey,
+					"operator": "and",
+				},
+			},
+		},
+		"size": 1000,
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", dataPath(ctx, "downloader")+"/_search", query, &esResp); err != nil {
+		if isNotFound(err) {
+			return []downloaderProfile{}, nil
+		}
+		return nil, err
+	}
+	profiles := make([]downloaderProfile, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		var p downloaderProfile
+		if err := json.Unmarshal(hit.Source, &p); err != nil {
+			return nil, err
+		}
+		if p.ApiKey != apikey {
+			continue
+		}
+		p.Id = hit.Id
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func listDownloaders(ctx *context, user *apiUser, res http.ResponseWriter) {
+	profiles, err := listDownloaderProfiles(ctx, user.Key)
+	if err != nil {
+		panic(err)
+	}
+	for i := range profiles {
+		profiles[i] = profiles[i].public()
+	}
+	writeJson(res, 200, profiles)
+}
+
+func createDownloader(ctx *context, user *apiUser, res http.ResponseWriter, req *http.Request) {
+	var p downloaderProfile
+	if req.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			jsonError(res, 400, "invalid json: "+err.Error())
+			return
+		}
+	} else {
+		req.ParseForm()
+		p.Name = req.FormValue("name")
+		p.Type = req.FormValue("type")
+		p.Url = req.FormValue("url")
+		p.Key = req.FormValue("key")
+		p.Username = req.FormValue("username")
+		p.Password = req.FormValue("password")
+		p.Category = req.FormValue("category")
+	}
+	p.Type = strings.ToLower(p.Type)
+	if p.Type != DOWNLOADER_SABNZBD && p.Type != DOWNLOADER_NZBGET {
+		jsonError(res, 400, "type must be sabnzbd or nzbget")
+		return
+	}
+	if err := checkOutboundUrl(p.Url, user); err != nil {
+		jsonError(res, 400, "url "+err.Error())
+		return
+	}
+	p.Url = strings.TrimSuffix(p.Url, "/")
+	if p.Name == "" {
+		p.Name = p.Type
+	}
+	p.ApiKey = user.Key
+	p.Id = ""
+	var esResp struct {
+		Id string `json:"_id"`
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "downloader")+"?refresh=true", p, &esResp); err != nil {
+		panic(err)
+	}
+	p.Id = esResp.Id
+	writeJson(res, 201, p.public())
+}
+
+func deleteDownloader(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter) {
+	var esResp struct {
+		Source downloaderProfile `json:"_source"`
+	}
+	if err := esRequest(ctx, "GET", dataPath(ctx, "downloader")+"/"+params["id"], nil, &esResp); err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such downloader")
+			return
+		}
+		panic(err)
+	}
+	if esResp.Source.ApiKey != user.Key {
+		jsonError(res, 404, "no such downloader")
+		return
+	}
+	if err := esRequest(ctx, "DELETE", dataPath(ctx, "downloader")+"/"+params["id"]+"?refresh=true", nil, nil); err != nil {
+		panic(err)
+	}
+	res.WriteHeader(204)
+}
+
+// sendToDownloader builds the nzb for the posted uploads, exactly like a
+// POST to /nzb, and submits it to the user's downloader profile given by
+// id or name, which may be left out if the user only has one.
+func sendToDownloader(ctx *context, user *apiUser, res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	uploads := req.Form["nzb"]
+	if len(uploads) == 0 {
+		jsonError(res, 400, "no uploads selected")
+		return
+	}
+	profiles, err := listDownloaderProfiles(ctx, user.Key)
+	if err != nil {
+		panic(err)
+	}
+	var profile *downloaderProfile
+	want := req.FormValue("profile")
+	for i := range profiles {
+		if profiles[i].Id == want || profiles[i].Name == want {
+			profile = &profiles[i]
+			break
+		}
+	}
+	if want == "" {
+		switch len(profiles) {
+		case 0:
+			jsonError(res, 404, "no downloaders set up")
+			return
+		case 1:
+			profile = &profiles[0]
+		default:
+			jsonError(res, 400, "missing profile, choose one of your downloaders")
+			return
+		}
+	}
+	if profile == nil {
+		jsonError(res, 404, "no such downloader")
+		return
+	}
+
+	opts, err := parseNzbOptions(req)
+	if err != nil {
+		jsonError(res, 400, "invalid file selection: "+err.Error())
+		return
+	}
+	if id, status := removedUpload(ctx, uploads); status == 410 {
+		jsonError(res, 410, "upload "+id+" has been removed")
+		return
+	} else if status == 404 {
+		jsonError(res, 404, "no such upload "+id)
+		return
+	}
+	opts.Name = req.FormValue("name")
+	nzbdl, nzbName := buildNzb(ctx, uploads, opts)
+	result := sendResult{
+		Downloader: profile.Name,
+		Name:       nzbName,
+		Files:      len(nzbdl.Files),
+	}
+	if len(nzbdl.Files) == 0 && opts.Selection != nil {
+		result.Error = nothingSelected
+		writeJson(res, 400, result)
+		return
+	} else if len(nzbdl.Files) == 0 {
+		result.Error = "the selected uploads have no files"
+		writeJson(res, 404, result)
+		return
+	}
+	category := profile.Category
+	if c := req.FormValue("category"); c != "" {
+		category = c
+	}
+	output := marshalNzb(nzbdl)
+	client := downloaderClient
+	if user.Admin {
+		client = adminDownloaderClient
+	}
+	switch profile.Type {
+	case DOWNLOADER_SABNZBD:
+		result.Id, err = sabnzbdAddFile(client, profile, nzbName, category, output)
+	case DOWNLOADER_NZBGET:
+		result.Id, err = nzbgetAppend(client, profile, nzbName, category, output)
+	default:
+		err = errors.New("unknown downloader type " + profile.Type)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		writeJson(res, 502, result)
+		return
+	}
+	result.Ok = true
+	writeJson(res, 200, result)
+}
+
+// sabnzbdAddFile uploads an nzb through the SABnzbd api (mode=addfile).
+func sabnzbdAddFile(client *http.Client, p *downloaderProfile, name string, category string, content []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("name", name)
+	if err != nil {
+		return "", err
+	}
+	part.Write(content)
+	w.Close()
+
+	params := url.Values{}
+	params.Set("mode", "addfile")
+	params.Set("output", "json")
+	params.Set("apikey", p.Key)
+	params.Set("nzbname", strings.TrimSuffix(name, ".nzb"))
+	if category != "" {
+		params.Set("cat", category)
+	}
+	req, err := http.NewRequest("POST", p.Url+"/api?"+params.Encode(), &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	var sabResp struct {
+		Status bool     `json:"status"`
+		Error  string   `json:"error"`
+		NzoIds []string `json:"nzo_ids"`
+	}
+	if err := doDownloaderRequest(client, req, &sabResp); err != nil {
+		return "", err
+	}
+	if !sabResp.Status {
+		if sabResp.Error == "" {
+			sabResp.Error = "rejected by sabnzbd"
+		}
+		return "", errors.New(sabResp.Error)
+	}
+	return strings.Join(sabResp.NzoIds, ","), nil
+}
+
+// nzbgetAppend adds an nzb to NZBGet's queue through its JSON-RPC api.
+func nzbgetAppend(client *http.Client, p *downloaderProfile, name string, category string, content []byte) (string, error) {
+	rpc := map[string]interface{}{
+		"version": "1.1",
+		"id":      1,
+		"method":  "append",
+		// NZBFilename, Content, Category, Priority, AddToTop, AddPaused,
+		// DupeKey, DupeScore, DupeMode, PPParameters
+		"params": []interface{}{
+			name,
+			base64.StdEncoding.EncodeToString(content),
+			category,
+			0,
+			false,
+			false,
+			"",
+			0,
+			"SCORE",
+			[]interface{}{},
+		},
+	}
+	b, err := json.Marshal(rpc)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", p.Url+"/jsonrpc", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.Username != "" || p.Password != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	var rpcResp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := doDownloaderRequest(client, req, &rpcResp); err != nil {
+		return "", err
+	}
+	if rpcResp.Error != nil {
+		return "", errors.New(rpcResp.Error.Message)
+	}
+	// append returns the new NZBID, or 0 (false in older versions) on failure.
+	id := string(rpcResp.Result)
+	if id == "" || id == "0" || id == "false" || id == "null" {
+		return "", errors.New("rejected by nzbget")
+	}
+	return id, nil
+}
+
+func doDownloaderRequest(client *http.Client, req *http.Request, v interface{}) error {
+	req.Header.Set("User-Agent", "animezb")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer io.Copy(ioutil.Discard, resp.Body)
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return errors.New("downloader rejected the credentials")
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("downloader returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unexpected response from downloader: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+type esError struct {
+	Status int
+	Body   string
+}
+
+func (e *esError) Error() string {
+	return fmt.Sprintf("elasticsearch: %d %s", e.Status, e.Body)
+}
+
+func isNotFound(err error) bool {
+	if e, ok := err.(*esError); ok {
+		return e.Status == 404
+	}
+	return false
+}
+
+type esSourceResp struct {
+	Hits struct {
+		Total int64 `json:"total"`
+		Hits  []struct {
+			Id     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// esRequest sends body, encoded as JSON, to path on the ElasticSearch
+// server and decodes the response into v. Either may be nil.
+func esRequest(ctx *context, method string, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	newReq, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", ctx.EsHost, ctx.EsPort, path), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		newReq.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(newReq)
+	if err != nil {
+		return err
+	}
+	defer io.Copy(ioutil.Discard, resp.Body)
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &esError{Status: resp.StatusCode, Body: string(b)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// dataPath returns the path of a document type in the index animezb keeps
+// its own data (saved searches, delivery logs, ...) in.
+func dataPath(ctx *context, docType string) string {
+	return "/" + ctx.DataIndex + "/" + docType
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JSONFEED_VERSION = "https://jsonfeed.org/version/1.1"
+
+	NEWZNAB_INCORRECT_PARAMETER = 201
+)
+
+// feedPage is a page of search results, shared by the rss, atom and json
+// feeds.
+type feedPage struct {
+	Query   string
+	Offset  int
+	Limit   int
+	Total   int64
+	Results []searchResult
+	Urls    *urlBuilder
+	// Cursor the page was fetched with, and those of its neighbours.
+	Cursor *searchCursor
+	Older  *searchCursor
+	Newer  *searchCursor
+	req    *http.Request
+}
+
+// searchFeed runs the search of a feed request: q, offset or cursor, limit
+// (or max), minavail, collapse and poster, an exact poster name. Without a
+// query it serves the home page, and for a query that doesn't parse an
+// error, and returns nil.
+func searchFeed(ctx *context, res http.ResponseWriter, req *http.Request) *feedPage {
+	req.ParseForm()
+	var searchQuery string
+	if q, ok := req.Form["q"]; ok {
+		if q[0] == "" {
+			searchQuery = "*"
+		} else {
+			searchQuery = q[0]
+		}
+	} else {
+		switch req.URL.Path {
+		case "/rss", "/atom", "/feed.json":
+			searchQuery = "*"
+		}
+	}
+	// max is the old name of limit.
+	limit := 50
+	if n, err := strconv.Atoi(req.FormValue("max")); err == nil && n > 0 {
+		limit = n
+	}
+	if n, err := strconv.Atoi(req.FormValue("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > rssMaxItems {
+		limit = rssMaxItems
+	}
+	offset := 0
+	if n, err := strconv.Atoi(req.FormValue("offset")); err == nil && n > 0 {
+		offset = n
+	}
+	var cursor *searchCursor
+	if token := req.FormValue("cursor"); token != "" {
+		c, err := parseCursor(token)
+		if err != nil {
+			feedError(res, req, err.Error())
+			return nil
+		}
+		cursor, offset = c, 0
+	}
+	if searchQuery == "" {
+		if f, err := ctx.HtmlDir.Open("/home.html"); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err != nil {
+				panic("Failed to stat index.html file.")
+			} else {
+				mod := fi.ModTime()
+				http.ServeContent(res, req, "/index.html", mod, f)
+			}
+		}
+		return nil
+	}
+	found, err := searchBackend(ctx, searchOptions{
+		Query:        searchQuery,
+		Offset:       offset,
+		Length:       limit,
+		OnlyComplete: true,
+
+		MinAvailability: parseMinAvailability(req),
+		Collapse:        req.FormValue("collapse") == "1",
+		Highlight:       true,
+		Cursor:          cursor,
+		Poster:          req.FormValue("poster"),
+	})
+	if err != nil {
+		feedError(res, req, err.Error())
+		return nil
+	}
+	return &feedPage{
+		Query:   searchQuery,
+		Offset:  offset,
+		Limit:   limit,
+		Total:   found.Total,
+		Results: found.Results,
+		Urls:    ctx.urls(req),
+		Cursor:  cursor,
+		Older:   found.Older,
+		Newer:   found.Newer,
+		req:     req,
+	}
+}
+
+// feedError answers a bad feed request in the format of the feed.
+func feedError(res http.ResponseWriter, req *http.Request, message string) {
+	switch {
+	case req.URL.Path == "/feed.json" || req.FormValue("format") == "json":
+		jsonError(res, 400, message)
+	case req.URL.Path == "/atom" || req.FormValue("format") == "atom":
+		http.Error(res, message, 400)
+	default:
+		body := newznabError(res, NEWZNAB_INCORRECT_PARAMETER, html.EscapeString(message))
+		res.WriteHeader(400)
+		res.Write([]byte(body))
+	}
+}
+
+// pageUri returns the request uri with its offset and limit replaced.
+func pageUri(req *http.Request, offset int, limit int) string {
+	q := req.URL.Query()
+	q.Del("max")
+	q.Del("cursor")
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+	return req.URL.Path + "?" + q.Encode()
+}
+
+// cursorUri returns the request uri paging with a cursor instead.
+func cursorUri(req *http.Request, cursor *searchCursor, limit int) string {
+	q := req.URL.Query()
+	q.Del("max")
+	q.Del("offset")
+	q.Set("cursor", cursor.String())
+	q.Set("limit", strconv.Itoa(limit))
+	return req.URL.Path + "?" + q.Encode()
+}
+
+func (p *feedPage) self() string {
+	return p.Urls.Abs(p.req.URL.RequestURI())
+}
+
+// prev and next return the urls of the neighbouring pages, or "" at either
+// end. Pages past maxSearchOffset are linked to with cursors.
+func (p *feedPage) prev() string {
+	if p.Cursor != nil {
+		if p.Newer == nil {
+			return ""
+		}
+		return p.Urls.Abs(cursorUri(p.req, p.Newer, p.Limit))
+	}
+	if p.Offset == 0 {
+		return ""
+	}
+	prev := p.Offset - p.Limit
+	if prev < 0 {
+		prev = 0
+	}
+	return p.Urls.Abs(pageUri(p.req, prev, p.Limit))
+}
+
+func (p *feedPage) next() string {
+	if p.Cursor != nil || p.Offset+p.Limit > maxSearchOffset {
+		if p.Older == nil {
+			return ""
+		}
+		return p.Urls.Abs(cursorUri(p.req, p.Older, p.Limit))
+	}
+	if int64(p.Offset+p.Limit) >= p.Total {
+		return ""
+	}
+	return p.Urls.Abs(pageUri(p.req, p.Offset+p.Limit, p.Limit))
+}
+
+// links returns the self and paging links of the feed.
+func (p *feedPage) links(mimeType string) []AtomLink {
+	links := []AtomLink{{Href: p.self(), Rel: "self", Type: mimeType}}
+	if prev := p.prev(); prev != "" {
+		links = append(links, AtomLink{Href: prev, Rel: "previous", Type: mimeType})
+	}
+	if next := p.next(); next != "" {
+		links = append(links, AtomLink{Href: next, Rel: "next", Type: mimeType})
+	}
+	return links
+}
+
+// updated is the date of the newest result.
+func (p *feedPage) updated() time.Time {
+	var t time.Time
+	for _, r := range p.Results {
+		if r.Time.After(t) {
+			t = r.Time
+		}
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC()
+}
+
+func nzbUrl(urls *urlBuilder, sr searchResult) string {
+	return urls.Abs("/nzb/" + sr.UploadId + "/" + urlPath(sr.Name) + ".nzb")
+}
+
+type atomFeed struct {
+	XMLName      xml.Name    `xml:"feed"`
+	Xmlns        string      `xml:"xmlns,attr"`
+	XmlnsNewzNab string      `xml:"xmlns:newznab,attr"`
+	Id           string      `xml:"id"`
+	Title        string      `xml:"title"`
+	Subtitle     string      `xml:"subtitle"`
+	Updated      string      `xml:"updated"`
+	Links        []AtomLink  `xml:"link"`
+	Entries      []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Id         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Author     string         `xml:"author>name"`
+	Links      []AtomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary"`
+	Attrs      []NewznabAttr  `xml:"newznab:attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// genatom serves the search as an atom feed, with the nzb as the enclosure
+// of each entry and its details as newznab attributes.
+func genatom(ctx *context, res http.ResponseWriter, req *http.Request) {
+	page := searchFeed(ctx, res, req)
+	if page == nil {
+		return
+	}
+	urls := page.Urls
+	feed := atomFeed{
+		Xmlns:        ATOM_XMLNS,
+		XmlnsNewzNab: NEWZNAB_XMLNS,
+		Id:           page.self(),
+		Title:        page.Query + " - Animezb",
+		Subtitle:     "Usenet Indexer for Japanese Media",
+		Updated:      page.updated().Format(time.RFC3339),
+		Links:        page.links("application/atom+xml"),
+		Entries:      make([]atomEntry, len(page.Results)),
+	}
+	feed.Links = append(feed.Links, AtomLink{Href: urls.Abs("/"), Rel: "alternate", Type: "text/html"})
+	for idx, r := range page.Results {
+		e := atomEntry{
+			Id:        urls.Abs("/nzb/" + r.UploadId),
+			Title:     r.Name,
+			Updated:   r.Time.UTC().Format(time.RFC3339),
+			Published: r.Time.UTC().Format(time.RFC3339),
+			Author:    r.Poster,
+			Links: []AtomLink{
+				{Href: nzbUrl(urls, r), Rel: "enclosure", Type: "application/x-nzb", Length: r.Bytes},
+				{Href: urls.Abs("/upload/" + r.UploadId), Rel: "alternate", Type: "text/html"},
+			},
+			Summary: r.Subject,
+			Attrs:   newznabAttrs(r),
+		}
+		for _, g := range r.Groups {
+			e.Categories = append(e.Categories, atomCategory{Term: g})
+		}
+		e.Attrs = append(e.Attrs,
+			NewznabAttr{Name: "completion", Value: strings.TrimSuffix(r.Completion, "%")},
+			NewznabAttr{Name: "poster", Value: r.Poster})
+		for _, g := range r.Groups {
+			e.Attrs = append(e.Attrs, NewznabAttr{Name: "group", Value: g})
+		}
+		if r.Availability != "" {
+			e.Attrs = append(e.Attrs, NewznabAttr{Name: "availability", Value: strings.TrimSuffix(r.Availability, "%")})
+		}
+		feed.Entries[idx] = e
+	}
+	if output, err := xml.Marshal(feed); err == nil {
+		res.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		res.WriteHeader(200)
+		res.Write([]byte(xml.Header))
+		res.Write(output)
+	} else {
+		panic(err)
+	}
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	NextUrl     string         `json:"next_url,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+	Animezb     struct {
+		Offset   int    `json:"offset"`
+		Total    int64  `json:"total"`
+		Updated  string `json:"updated"`
+		Previous string `json:"previous_url,omitempty"`
+		// Cursors of the next and previous pages.
+		NextCursor string `json:"next_cursor,omitempty"`
+		PrevCursor string `json:"previous_cursor,omitempty"`
+	} `json:"_animezb"`
+}
+
+type jsonFeedItem struct {
+	Id            string               `json:"id"`
+	Url           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentText   string               `json:"content_text"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Authors       []jsonFeedAuthor     `json:"authors"`
+	Tags          []string             `json:"tags"`
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+	Animezb       jsonFeedUpload       `json:"_animezb"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	Url         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	Title       string `json:"title"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+// jsonFeedUpload is the _animezb extension of each item.
+type jsonFeedUpload struct {
+	UploadId       string   `json:"id"`
+	Subject        string   `json:"subject"`
+	Poster         string   `json:"poster"`
+	Groups         []string `json:"groups"`
+	Bytes          int64    `json:"bytes"`
+	ContentBytes   int64    `json:"contentbytes"`
+	RecoveryBytes  int64    `json:"recoverybytes"`
+	Completion     string   `json:"completion"`
+	CompletedParts string   `json:"complete"`
+	TotalParts     string   `json:"length"`
+	Availability   string   `json:"availability,omitempty"`
+	Files          string   `json:"files"`
+	AnimeId        int      `json:"anidbid,omitempty"`
+	AnimeTitle     string   `json:"animetitle,omitempty"`
+	Alternatives   int      `json:"alternatives,omitempty"`
+	// Only there when the query matched the name or subject.
+	Highlight *jsonFeedHighlight `json:"highlight,omitempty"`
+}
+
+// jsonFeedHighlight is the name and the parts of the subject a query
+// matched, as HTML with the words matched in <mark>.
+type jsonFeedHighlight struct {
+	Name    string `json:"name,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// genjsonfeed serves the search as a JSON Feed, with the nzb attached to
+// each item and its details in the _animezb extension.
+func genjsonfeed(ctx *context, res http.ResponseWriter, req *http.Request) {
+	page := searchFeed(ctx, res, req)
+	if page == nil {
+		return
+	}
+	urls := page.Urls
+	feed := jsonFeed{
+		Version:     JSONFEED_VERSION,
+		Title:       page.Query + " - Animezb",
+		Description: "Usenet Indexer for Japanese Media",
+		HomePageUrl: urls.Abs("/"),
+		FeedUrl:     page.self(),
+		NextUrl:     page.next(),
+		Items:       make([]jsonFeedItem, len(page.Results)),
+	}
+	feed.Animezb.Offset = page.Offset
+	feed.Animezb.Total = page.Total
+	feed.Animezb.Updated = page.updated().Format(time.RFC3339)
+	feed.Animezb.Previous = page.prev()
+	if page.Older != nil {
+		feed.Animezb.NextCursor = page.Older.String()
+	}
+	if page.Newer != nil {
+		feed.Animezb.PrevCursor = page.Newer.String()
+	}
+	for idx, r := range page.Results {
+		groups := r.Groups
+		if groups == nil {
+			groups = []string{}
+		}
+		var highlight *jsonFeedHighlight
+		if r.NameHighlight != "" || r.SubjectHighlight != "" {
+			highlight = &jsonFeedHighlight{Name: r.NameHighlight, Subject: r.SubjectHighlight}
+		}
+		feed.Items[idx] = jsonFeedItem{
+			Id:            urls.Abs("/nzb/" + r.UploadId),
+			Url:           urls.Abs("/upload/" + r.UploadId),
+			Title:         r.Name,
+			ContentText:   r.Subject,
+			DatePublished: r.Time.UTC().Format(time.RFC3339),
+			DateModified:  r.Time.UTC().Format(time.RFC3339),
+			Authors:       []jsonFeedAuthor{{Name: r.Poster}},
+			Tags:          groups,
+			Attachments: []jsonFeedAttachment{{
+				Url:         nzbUrl(urls, r),
+				MimeType:    "application/x-nzb",
+				Title:       r.Name + ".nzb",
+				SizeInBytes: r.Bytes,
+			}},
+			Animezb: jsonFeedUpload{
+				UploadId:       r.UploadId,
+				Subject:        r.Subject,
+				Poster:         r.Poster,
+				Groups:         groups,
+				Bytes:          r.Bytes,
+				ContentBytes:   r.ContentBytes,
+				RecoveryBytes:  r.RecoveryBytes,
+				Completion:     r.Completion,
+				CompletedParts: r.CompletedParts,
+				TotalParts:     r.TotalParts,
+				Availability:   r.Availability,
+				Files:          r.ExtTypes,
+				AnimeId:        r.AnimeId,
+				AnimeTitle:     r.AnimeTitle,
+				Alternatives:   r.Alternatives,
+				Highlight:      highlight,
+			},
+		}
+	}
+	if output, err := json.Marshal(feed); err == nil {
+		res.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+		res.WriteHeader(200)
+		res.Write(output)
+	} else {
+		panic(err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// groupPage lists the latest uploads to a newsgroup.
+type groupPage struct {
+	Name string `json:"name"`
+	uploadStats
+	Ingest ingestRate      `json:"ingest"`
+	Latest []uploadSummary `json:"latest"`
+	// Cursors of the pages of older and newer uploads.
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"previous_cursor,omitempty"`
+	Links      struct {
+		Page string `json:"page"`
+		Rss  string `json:"rss"`
+		Next string `json:"next,omitempty"`
+		Prev string `json:"previous,omitempty"`
+	} `json:"links"`
+}
+
+// groupIngest counts the uploads to a newsgroup over the last hour and day.
+func groupIngest(ctx *context, name string, query map[string]interface{}) ingestRate {
+	now := time.Now()
+	since := func(d time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"filter": map[string]interface{}{
+				"range": map[string]interface{}{
+					"date": map[string]interface{}{
+						"gte": now.Add(-d).Format(time.RFC3339),
+					},
+				},
+			},
+		}
+	}
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query":  query,
+				"filter": visibleFilter(ctx),
+			},
+		},
+		"aggs": map[string]interface{}{
+			"lasthour": since(time.Hour),
+			"lastday":  since(24 * time.Hour),
+		},
+		"size": 0,
+	}
+	var esResp struct {
+		Aggregations struct {
+			LastHour struct {
+				Count int64 `json:"doc_count"`
+			} `json:"lasthour"`
+			LastDay struct {
+				Count int64 `json:"doc_count"`
+			} `json:"lastday"`
+		} `json:"aggregations"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", body, &esResp); err != nil {
+		panic(err)
+	}
+	return ingestRate{
+		Group:    name,
+		LastHour: esResp.Aggregations.LastHour.Count,
+		LastDay:  esResp.Aggregations.LastDay.Count,
+		PerHour:  float64(esResp.Aggregations.LastDay.Count) / 24,
+	}
+}
+
+// getGroupPage serves the latest uploads to a newsgroup, paged with
+// cursors, as html or, with format=json, as json.
+func getGroupPage(ctx *context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	name := newsgroup(params["name"])
+	if !strings.Contains(name, ".") {
+		jsonError(res, 404, "no such newsgroup")
+		return
+	}
+	var cursor *searchCursor
+	if token := req.FormValue("cursor"); token != "" {
+		var err error
+		if cursor, err = parseCursor(token); err != nil {
+			jsonError(res, 400, err.Error())
+			return
+		}
+	}
+	query := map[string]interface{}{
+		"match": map[string]interface{}{
+			"group": map[string]interface{}{
+				"query": name,
+				"type":  "phrase",
+			},
+		},
+	}
+	g := groupPage{
+		Name:        name,
+		uploadStats: aggregateUploads(ctx, query),
+	}
+	if g.Uploads == 0 {
+		jsonError(res, 404, "no uploads to this newsgroup")
+		return
+	}
+	g.Ingest = groupIngest(ctx, name, query)
+	page, err := searchBackend(ctx, searchOptions{
+		Query:  "group:" + quotePhrase(name),
+		Length: browseUploads,
+		Cursor: cursor,
+	})
+	if err != nil {
+		jsonError(res, 400, err.Error())
+		return
+	}
+	urls := ctx.urls(req)
+	g.Latest = summarizeUploads(urls, page.Results)
+	g.Links.Page = urls.Abs("/group/" + urlPath(name))
+	g.Links.Rss = urls.Abs("/rss/group/" + urlPath(name))
+	if page.Older != nil {
+		g.NextCursor = page.Older.String()
+		g.Links.Next = g.Links.Page + "?cursor=" + g.NextCursor
+	}
+	if page.Newer != nil {
+		g.PrevCursor = page.Newer.String()
+		g.Links.Prev = g.Links.Page + "?cursor=" + g.PrevCursor
+	}
+
+	if wantsJson(req) {
+		writeJson(res, 200, g)
+		return
+	}
+	res.Header().Set("Content-Type", "text/html")
+	renderTemplate(res, "group.html", struct {
+		groupPage
+		Base    string
+		UrlPath func(string) string
+	}{g, urls.Prefix, urlPath})
+}
+
+// groupFeed serves the uploads to a newsgroup as a feed, in any of the
+// formats of genrss.
+func groupFeed(ctx *context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	name := newsgroup(params["name"])
+	if !strings.Contains(name, ".") {
+		jsonError(res, 404, "no such newsgroup")
+		return
+	}
+	req.ParseForm()
+	req.Form.Set("q", "group:"+quotePhrase(name))
+	genrss(ctx, res, req)
+}
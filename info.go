@@ -9,13 +9,17 @@ import (
 )
 
 type uploadInfo struct {
+	Id    string     `json:"id"`
 	Files []fileInfo `json:"files"`
 }
 
 type fileInfo struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
 	Date    string `json:"date"`
 	Time    int64  `json:"time"`
 	Subject string `json:"subject"`
+	Class   string `json:"class"`
 	Parts   int    `json:"parts"`
 	Length  int    `json:"length"`
 	Size    string `json:"size"`
@@ -31,13 +35,17 @@ func getUploadInfo(ctx *context, params martini.Params, res http.ResponseWriter,
 	uploadId := params["nzbid"]
 	files := getFiles(ctx, uploadId)
 	r := uploadInfo{
+		Id:    uploadId,
 		Files: make([]fileInfo, len(files)),
 	}
 	for idx, file := range files {
 		fi := fileInfo{
+			Id:      file.Id,
+			Name:    file.Name,
 			Date:    time.Unix(file.Date, 0).Format("2006-01-02"),
 			Time:    file.Date,
 			Subject: file.Subject,
+			Class:   classifyFile(file.Name),
 			Parts:   file.Parts,
 			Length:  file.Length,
 			Size:    ByteSize(file.Bytes).String(),
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type mergeReport struct {
+	Uploads    []string          `json:"uploads"`
+	Files      []mergeFileReport `json:"files"`
+	Segments   int               `json:"segments"`
+	Found      int               `json:"found"`
+	Completion string            `json:"completion"`
+	Complete   bool              `json:"complete"`
+}
+
+type mergeFileReport struct {
+	Name       string `json:"name"`
+	Length     int    `json:"length"`
+	Found      int    `json:"found"`
+	Sources    int    `json:"sources"`
+	Completion string `json:"completion"`
+}
+
+type mergedFile struct {
+	NzbFile
+	segments map[uint32]NzbSegment
+	sources  map[string]bool
+}
+
+// mergeKey matches the same file across uploads. The size can't be used,
+// partial copies are smaller, but the number of parts in the subject is the
+// same.
+func mergeKey(f NzbFile) string {
+	return normalizeTitle(f.Name) + "|" + strconv.Itoa(f.Length)
+}
+
+// mergeUploads combines several uploads of the same release into one list
+// of files, taking every segment number from whichever upload has it. A
+// single upload is merged with its known duplicates.
+func mergeUploads(ctx *context, uploads []string, sel *fileSelection) ([]NzbFile, mergeReport) {
+	if len(uploads) == 1 {
+		if upload, err := getUpload(ctx, uploads[0]); err == nil {
+			for _, dup := range getDuplicates(ctx, upload.Fingerprint) {
+				if dup != uploads[0] {
+					uploads = append(uploads, dup)
+				}
+			}
+		}
+	}
+	report := mergeReport{Uploads: uploads}
+	merged := make(map[string]*mergedFile)
+	order := make([]string, 0, 16)
+	for _, upload := range uploads {
+		for _, f := range sel.apply(getFiles(ctx, upload)) {
+			k := mergeKey(f)
+			m, ok := merged[k]
+			if !ok {
+				m = &mergedFile{
+					NzbFile:  f,
+					segments: make(map[uint32]NzbSegment),
+					sources:  make(map[string]bool),
+				}
+				merged[k] = m
+				order = append(order, k)
+			}
+			found := len(m.segments)
+			for _, seg := range getSegments(ctx, f.Id) {
+				if _, ok := m.segments[seg.Number]; !ok {
+					m.segments[seg.Number] = seg
+				}
+			}
+			if len(m.segments) > found {
+				m.sources[upload] = true
+			}
+		}
+	}
+
+	files := make([]NzbFile, 0, len(order))
+	for _, k := range order {
+		m := merged[k]
+		f := m.NzbFile
+		f.Segments = make([]NzbSegment, 0, len(m.segments))
+		for _, seg := range m.segments {
+			f.Segments = append(f.Segments, seg)
+		}
+		sort.Sort(nzbSegments(f.Segments))
+		f.Parts = len(f.Segments)
+		files = append(files, f)
+
+		fr := mergeFileReport{
+			Name:    f.Name,
+			Length:  f.Length,
+			Found:   f.Parts,
+			Sources: len(m.sources),
+		}
+		fr.Completion = percent(fr.Found, fr.Length)
+		report.Files = append(report.Files, fr)
+		report.Segments += f.Length
+		report.Found += f.Parts
+	}
+	report.Completion = percent(report.Found, report.Segments)
+	report.Complete = report.Segments > 0 && report.Found >= report.Segments
+	return files, report
+}
+
+func percent(n int, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	if n >= total {
+		return "100%"
+	}
+	return fmt.Sprintf("%0.2f%%", float64(n)/float64(total)*100)
+}
+
+type nzbSegments []NzbSegment
+
+func (s nzbSegments) Len() int           { return len(s) }
+func (s nzbSegments) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s nzbSegments) Less(i, j int) bool { return s[i].Number < s[j].Number }
+
+// previewMerge reports the combined completion of merging the given
+// uploads, without building the nzb.
+func previewMerge(ctx *context, res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	uploads := splitFormValues(req.Form["nzb"])
+	if len(uploads) == 0 {
+		jsonError(res, 400, "no uploads selected")
+		return
+	}
+	sel, err := parseFileSelection(req)
+	if err != nil {
+		jsonError(res, 400, "invalid file selection: "+err.Error())
+		return
+	}
+	if id, status := removedUpload(ctx, uploads); status == 410 {
+		jsonError(res, 410, "upload "+id+" has been removed")
+		return
+	} else if status == 404 {
+		jsonError(res, 404, "no such upload "+id)
+		return
+	}
+	_, report := mergeUploads(ctx, uploads, sel)
+	if sel != nil && len(report.Files) == 0 {
+		jsonError(res, 400, nothingSelected)
+		return
+	}
+	writeJson(res, 200, report)
+}
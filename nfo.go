@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Largest nfo fetched from the NNTP server.
+const nfoMaxBytes = 64 * 1024
+
+// The upper half of code page 437, which most nfos are written in.
+var cp437 = []rune("ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0")
+
+type nfoInfo struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// decodeYenc decodes a yEnc encoded article body. Bodies that aren't yEnc
+// encoded are returned as they are.
+func decodeYenc(body []byte) []byte {
+	if !bytes.HasPrefix(body, []byte("=ybegin ")) && !bytes.Contains(body, []byte("\n=ybegin ")) {
+		return body
+	}
+	out := make([]byte, 0, len(body))
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if bytes.HasPrefix(line, []byte("=y")) {
+			continue
+		}
+		for i := 0; i < len(line); i++ {
+			b := line[i]
+			if b == '=' && i+1 < len(line) {
+				i++
+				b = line[i] - 64
+			}
+			out = append(out, b-42)
+		}
+	}
+	return out
+}
+
+// decodeNfo turns an nfo into text, reading it as code page 437 unless it
+// is valid UTF-8.
+func decodeNfo(b []byte) string {
+	var text string
+	if utf8.Valid(b) {
+		text = string(b)
+	} else {
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			if c < 0x80 {
+				runes[i] = rune(c)
+			} else {
+				runes[i] = cp437[c-0x80]
+			}
+		}
+		text = string(runes)
+	}
+	return strings.TrimRight(strings.Replace(text, "\r\n", "\n", -1), "\n\x00\x1a")
+}
+
+// uploadNfo returns the nfo of an upload, fetching it from the NNTP server
+// the first time and keeping it in the data index. It returns nil if the
+// upload has no nfo or it can't be fetched.
+func uploadNfo(ctx *context, uploadId string, files []NzbFile) *nfoInfo {
+	var nfoFile *NzbFile
+	for i, f := range files {
+		if strings.ToLower(path.Ext(strings.TrimSuffix(f.Name, "."))) == ".nfo" && f.Bytes <= nfoMaxBytes {
+			nfoFile = &files[i]
+			break
+		}
+	}
+	if nfoFile == nil {
+		return nil
+	}
+	var esResp struct {
+		Source nfoInfo `json:"_source"`
+	}
+	err := esRequest(ctx, "GET", dataPath(ctx, "nfo")+"/"+uploadId, nil, &esResp)
+	if err == nil {
+		return &esResp.Source
+	} else if !isNotFound(err) {
+		panic(err)
+	}
+	if ctx.Nntp == nil {
+		return nil
+	}
+	segments := getSegments(ctx, nfoFile.Id)
+	sort.Sort(nzbSegments(segments))
+	var content []byte
+	for _, seg := range segments {
+		body, err := ctx.Nntp.body(seg.MessageId)
+		if err != nil {
+			log.Printf("Failed to fetch the nfo of %s: %s", uploadId, err)
+			return nil
+		}
+		content = append(content, decodeYenc(body)...)
+	}
+	nfo := &nfoInfo{Name: nfoFile.Name, Text: decodeNfo(content)}
+	if err := esRequest(ctx, "PUT", dataPath(ctx, "nfo")+"/"+uploadId, nfo, nil); err != nil {
+		log.Printf("Failed to store the nfo of %s: %s", uploadId, err)
+	}
+	return nfo
+}
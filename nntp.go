@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const nntpTimeout = 60 * time.Second
+
+var errNoArticle = errors.New("nntp: no such article")
+
+type nntpConfig struct {
+	Addr     string
+	Username string
+	Password string
+	TLS      bool
+	MaxConns int
+}
+
+type nntpConn struct {
+	net.Conn
+	text *textproto.Conn
+}
+
+// dialNntp connects to an NNTP server and authenticates with AUTHINFO
+// USER/PASS if a username is configured.
+func dialNntp(cfg nntpConfig) (*nntpConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: nntpTimeout}
+	if cfg.TLS {
+		host := cfg.Addr
+		if h, _, err := net.SplitHostPort(cfg.Addr); err == nil {
+			host = h
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &nntpConn{Conn: conn, text: textproto.NewConn(conn)}
+	c.SetDeadline(time.Now().Add(nntpTimeout))
+	if _, _, err := c.text.ReadCodeLine(20); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if cfg.Username != "" {
+		if err := c.auth(cfg.Username, cfg.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *nntpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.SetDeadline(time.Now().Add(nntpTimeout))
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadCodeLine(expect)
+}
+
+func (c *nntpConn) auth(username string, password string) error {
+	code, msg, err := c.cmd(0, "AUTHINFO USER %s", username)
+	if err != nil {
+		return err
+	}
+	if code == 381 {
+		code, msg, err = c.cmd(0, "AUTHINFO PASS %s", password)
+		if err != nil {
+			return err
+		}
+	}
+	if code != 281 {
+		return fmt.Errorf("nntp: authentication failed: %d %s", code, msg)
+	}
+	return nil
+}
+
+func bracketMessageId(messageId string) string {
+	if !strings.HasPrefix(messageId, "<") {
+		return "<" + messageId + ">"
+	}
+	return messageId
+}
+
+// stat reports whether the server still has the article with the given
+// message id.
+func (c *nntpConn) stat(messageId string) (bool, error) {
+	code, msg, err := c.cmd(0, "STAT %s", bracketMessageId(messageId))
+	if err != nil {
+		return false, err
+	}
+	switch code {
+	case 223:
+		return true, nil
+	case 423, 430:
+		return false, nil
+	}
+	return false, fmt.Errorf("nntp: unexpected response to STAT: %d %s", code, msg)
+}
+
+// body fetches the body of an article, without dot stuffing.
+func (c *nntpConn) body(messageId string) ([]byte, error) {
+	c.SetDeadline(time.Now().Add(nntpTimeout))
+	id, err := c.text.Cmd("BODY %s", bracketMessageId(messageId))
+	if err != nil {
+		return nil, err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	code, msg, err := c.text.ReadCodeLine(0)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case 222:
+		return c.text.ReadDotBytes()
+	case 423, 430:
+		return nil, errNoArticle
+	}
+	return nil, fmt.Errorf("nntp: unexpected response to BODY: %d %s", code, msg)
+}
+
+// nntpPool keeps up to MaxConns authenticated connections to a server.
+type nntpPool struct {
+	cfg   nntpConfig
+	idle  chan *nntpConn
+	slots chan struct{}
+}
+
+func newNntpPool(cfg nntpConfig) *nntpPool {
+	if cfg.MaxConns < 1 {
+		cfg.MaxConns = 1
+	}
+	return &nntpPool{
+		cfg:   cfg,
+		idle:  make(chan *nntpConn, cfg.MaxConns),
+		slots: make(chan struct{}, cfg.MaxConns),
+	}
+}
+
+// get returns an idle connection, or dials a new one if fewer than
+// MaxConns are open. It blocks until a connection is available.
+func (p *nntpPool) get() (*nntpConn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-p.idle:
+		return c, nil
+	case p.slots <- struct{}{}:
+		return p.dial()
+	}
+}
+
+// dial opens a new connection in a slot already taken.
+func (p *nntpPool) dial() (*nntpConn, error) {
+	c, err := dialNntp(p.cfg)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool. Connections that saw an error are
+// closed rather than reused.
+func (p *nntpPool) put(c *nntpConn, err error) {
+	if err != nil {
+		c.Close()
+		<-p.slots
+		return
+	}
+	p.idle <- c
+}
+
+// do runs f on a pooled connection. If it fails, it is retried once on a
+// new connection, as the server may have dropped an idle one.
+func (p *nntpPool) do(f func(c *nntpConn) error) error {
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = f(c)
+	if err == nil || err == errNoArticle {
+		p.put(c, nil)
+		return err
+	}
+	p.put(c, err)
+	p.slots <- struct{}{}
+	if c, err = p.dial(); err != nil {
+		return err
+	}
+	err = f(c)
+	if err == errNoArticle {
+		p.put(c, nil)
+	} else {
+		p.put(c, err)
+	}
+	return err
+}
+
+// stat reports whether the server still has an article.
+func (p *nntpPool) stat(messageId string) (bool, error) {
+	var ok bool
+	err := p.do(func(c *nntpConn) (err error) {
+		ok, err = c.stat(messageId)
+		return err
+	})
+	return ok, err
+}
+
+// body fetches the body of an article.
+func (p *nntpPool) body(messageId string) ([]byte, error) {
+	var b []byte
+	err := p.do(func(c *nntpConn) (err error) {
+		b, err = c.body(messageId)
+		return err
+	})
+	return b, err
+}
+
+func (p *nntpPool) size() int {
+	return p.cfg.MaxConns
+}
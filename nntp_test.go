@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNntp is an NNTP server knowing a fixed set of articles.
+type fakeNntp struct {
+	net.Listener
+	Username string
+	Password string
+	// Articles the server has, by message id with brackets.
+	Articles map[string]bool
+	// Message ids STAT answers 503 for.
+	Broken map[string]bool
+	// Article bodies BODY answers with.
+	Bodies map[string][]byte
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newFakeNntp(t *testing.T, articles ...string) *fakeNntp {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNntp{Listener: l, Articles: make(map[string]bool), Broken: make(map[string]bool), Bodies: make(map[string][]byte)}
+	for _, a := range articles {
+		s.Articles["<"+a+">"] = true
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeNntp) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.dials++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeNntp) handle(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("200 fake news server ready")
+	authed := s.Username == ""
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "AUTHINFO":
+			if len(fields) == 3 && strings.ToUpper(fields[1]) == "USER" && fields[2] == s.Username {
+				text.PrintfLine("381 password required")
+			} else if len(fields) == 3 && strings.ToUpper(fields[1]) == "PASS" && fields[2] == s.Password {
+				authed = true
+				text.PrintfLine("281 authentication accepted")
+			} else {
+				text.PrintfLine("481 authentication failed")
+			}
+		case "STAT":
+			switch {
+			case !authed:
+				text.PrintfLine("480 authentication required")
+			case len(fields) < 2 || s.Broken[fields[1]]:
+				text.PrintfLine("503 program fault")
+			case s.Articles[fields[1]]:
+				text.PrintfLine("223 0 %s", fields[1])
+			default:
+				text.PrintfLine("430 no such article")
+			}
+		case "BODY":
+			switch {
+			case !authed:
+				text.PrintfLine("480 authentication required")
+			case len(fields) < 2 || s.Bodies[fields[1]] == nil:
+				text.PrintfLine("430 no such article")
+			default:
+				text.PrintfLine("222 0 %s", fields[1])
+				w := text.DotWriter()
+				w.Write(s.Bodies[fields[1]])
+				w.Close()
+			}
+		case "QUIT":
+			text.PrintfLine("205 bye")
+			return
+		default:
+			text.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+// drop closes every open connection, like a server timing out idle ones.
+func (s *fakeNntp) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeNntp) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func (s *fakeNntp) pool(conns int) *nntpPool {
+	return newNntpPool(nntpConfig{
+		Addr:     s.Addr().String(),
+		Username: s.Username,
+		Password: s.Password,
+		MaxConns: conns,
+	})
+}
+
+func TestNntpStat(t *testing.T) {
+	s := newFakeNntp(t, "part1@example")
+	defer s.Close()
+	c, err := dialNntp(nntpConfig{Addr: s.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for id, want := range map[string]bool{
+		"part1@example":   true,
+		"<part1@example>": true,
+		"part2@example":   false,
+	} {
+		ok, err := c.stat(id)
+		if err != nil {
+			t.Fatalf("stat %s: %s", id, err)
+		}
+		if ok != want {
+			t.Errorf("stat %s = %v, want %v", id, ok, want)
+		}
+	}
+	s.Broken["<part3@example>"] = true
+	if _, err := c.stat("part3@example"); err == nil {
+		t.Error("stat of a 503 answer didn't fail")
+	}
+}
+
+func TestNntpAuth(t *testing.T) {
+	s := newFakeNntp(t, "part1@example")
+	defer s.Close()
+	s.Username, s.Password = "user", "secret"
+
+	c, err := dialNntp(nntpConfig{Addr: s.Addr().String(), Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.stat("part1@example"); !ok || err != nil {
+		t.Errorf("stat after auth = %v, %v", ok, err)
+	}
+	c.Close()
+
+	if _, err := dialNntp(nntpConfig{Addr: s.Addr().String(), Username: "user", Password: "wrong"}); err == nil {
+		t.Error("dial with a wrong password succeeded")
+	}
+	c, err = dialNntp(nntpConfig{Addr: s.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.stat("part1@example"); err == nil {
+		t.Error("stat without auth didn't fail")
+	}
+}
+
+func TestNntpPoolDeadConnection(t *testing.T) {
+	s := newFakeNntp(t, "part1@example")
+	defer s.Close()
+	p := s.pool(1)
+	if ok, err := p.stat("part1@example"); !ok || err != nil {
+		t.Fatalf("stat = %v, %v", ok, err)
+	}
+	// The pooled connection is now dead, the next STAT has to redial.
+	s.drop()
+	if ok, err := p.stat("part1@example"); !ok || err != nil {
+		t.Fatalf("stat on a dropped connection = %v, %v", ok, err)
+	}
+	if n := s.dialCount(); n != 2 {
+		t.Errorf("dialed %d times, want 2", n)
+	}
+	// The slot of the dead connection was given back.
+	if ok, err := p.stat("part2@example"); ok || err != nil {
+		t.Errorf("stat = %v, %v", ok, err)
+	}
+}
+
+// yenc encodes b as a single part yEnc article body.
+func yenc(name string, b []byte) []byte {
+	out := []byte(fmt.Sprintf("=ybegin line=128 size=%d name=%s\r\n", len(b), name))
+	for _, c := range b {
+		c += 42
+		switch c {
+		case 0, '\n', '\r', '=', '.':
+			out = append(out, '=', c+64)
+		default:
+			out = append(out, c)
+		}
+	}
+	return append(out, []byte(fmt.Sprintf("\r\n=yend size=%d\r\n", len(b)))...)
+}
+
+func TestNntpBody(t *testing.T) {
+	s := newFakeNntp(t)
+	defer s.Close()
+	s.Bodies["<nfo@example>"] = yenc("a.nfo", []byte("..nfo\x80\xdb\r\n=\r\n"))
+	p := s.pool(1)
+	b, err := p.body("nfo@example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := decodeNfo(decodeYenc(b)); text != "..nfoÇ█\n=" {
+		t.Errorf("nfo = %q", text)
+	}
+	if _, err := p.body("missing@example"); err != errNoArticle {
+		t.Errorf("body of a missing article = %v, want %v", err, errNoArticle)
+	}
+}
@@ -75,17 +75,82 @@ func gennzb(ctx *context, params martini.Params, res http.ResponseWriter, req *h
 		req.ParseForm()
 		uploads = req.PostForm["nzb"]
 	}
+	res.Header().Set("Content-Type", "text/html")
+	opts, err := parseNzbOptions(req)
+	if opts.Merge && req.Method == "GET" {
+		// Other copies to merge with can be given as nzb=<id>.
+		uploads = append(uploads, splitFormValues(req.Form["nzb"])...)
+	}
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte("Invalid file selection: " + err.Error()))
+		return
+	}
+	if id, status := removedUpload(ctx, uploads); status == 410 {
+		res.WriteHeader(410)
+		res.Write([]byte("Upload " + id + " has been removed."))
+		return
+	} else if status == 404 {
+		res.WriteHeader(404)
+		res.Write([]byte("Upload " + id + " not found."))
+		return
+	}
+	opts.Name = params["nzbname"]
+	nzbdl, nzbName := buildNzb(ctx, uploads, opts)
+	if opts.Selection != nil && len(nzbdl.Files) == 0 {
+		res.WriteHeader(400)
+		res.Write([]byte("Invalid file selection: " + nothingSelected))
+		return
+	}
+	output := marshalNzb(nzbdl)
+	res.Header().Set("Content-Type", "application/x-nzb")
+	res.Header().Set("Content-Disposition", "attachment; filename=\""+nzbName+"\"")
+	res.WriteHeader(200)
+	res.Write(output)
+}
+
+type nzbOptions struct {
+	// Name of the nzb, the name of the first upload if empty.
+	Name      string
+	Selection *fileSelection
+	// Take each file from whichever duplicate of the upload has the most
+	// complete copy of it.
+	BestCopies bool
+	// Merge the uploads segment by segment into a single release.
+	Merge bool
+}
+
+func parseNzbOptions(req *http.Request) (nzbOptions, error) {
+	sel, err := parseFileSelection(req)
+	return nzbOptions{
+		Selection:  sel,
+		BestCopies: req.FormValue("best") == "1",
+		Merge:      req.FormValue("merge") == "1",
+	}, err
+}
+
+// buildNzb assembles the nzb for the given uploads.
+func buildNzb(ctx *context, uploads []string, opts nzbOptions) (nzb, string) {
 	nzbdl := nzb{
 		Xmlns: NZB_XMLNS,
 		Files: make([]NzbFile, 0, 16),
 	}
-	nzbName := params["nzbname"]
+	nzbName := opts.Name
 	if nzbName == "" && len(uploads) > 0 {
 		nzbName = getName(ctx, uploads[0])
 	}
-	res.Header().Set("Content-Type", "text/html")
+	if opts.Merge {
+		nzbdl.Files, _ = mergeUploads(ctx, uploads, opts.Selection)
+		uploads = nil
+	}
 	for _, upload := range uploads {
-		uploadFiles := getFiles(ctx, upload)
+		var uploadFiles []NzbFile
+		if opts.BestCopies {
+			uploadFiles = bestCopies(ctx, upload)
+		} else {
+			uploadFiles = getFiles(ctx, upload)
+		}
+		uploadFiles = opts.Selection.apply(uploadFiles)
 		for _, f := range uploadFiles {
 			if nzbName == "" {
 				nzbName = f.Name
@@ -97,16 +162,19 @@ func gennzb(ctx *context, params martini.Params, res http.ResponseWriter, req *h
 	if !strings.HasSuffix(nzbName, ".nzb") {
 		nzbName += ".nzb"
 	}
-	if output, err := xml.Marshal(nzbdl); err == nil {
-		res.Header().Set("Content-Type", "application/x-nzb")
-		res.Header().Set("Content-Disposition", "attachment; filename=\""+nzbName+"\"")
-		res.WriteHeader(200)
-		res.Write([]byte(xml.Header))
-		res.Write([]byte(`<!DOCTYPE nzb PUBLIC "-//newzBin//DTD NZB 1.0//EN" "http://www.newzbin.com/DTD/nzb/nzb-1.0.dtd">` + "\n"))
-		res.Write(output)
-	} else {
+	return nzbdl, nzbName
+}
+
+func marshalNzb(nzbdl nzb) []byte {
+	output, err := xml.Marshal(nzbdl)
+	if err != nil {
 		panic(err)
 	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<!DOCTYPE nzb PUBLIC "-//newzBin//DTD NZB 1.0//EN" "http://www.newzbin.com/DTD/nzb/nzb-1.0.dtd">` + "\n")
+	buf.Write(output)
+	return buf.Bytes()
 }
 
 func getName(ctx *context, upload string) string {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Requests to urls given by users, such as webhooks and downloaders, may
+// not reach the hosts animezb runs next to, like ElasticSearch, unless an
+// admin gave them.
+
+var errInternalHost = errors.New("url points to an internal address")
+
+var internalNets = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	}
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}()
+
+// internalIP reports whether ip is a loopback, link-local or private
+// address.
+func internalIP(ip net.IP) bool {
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicIPs resolves host, failing if any of its addresses is internal.
+func publicIPs(host string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if internalIP(ip) {
+			return nil, errInternalHost
+		}
+	}
+	return ips, nil
+}
+
+// dialPublic connects to addr if it only resolves to public addresses.
+// The address checked is the one dialed, so a host can't resolve to
+// another one in between.
+func dialPublic(network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := publicIPs(host)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout(network, net.JoinHostPort(ips[0].String(), port), 30*time.Second)
+}
+
+// newOutboundClient returns a client for urls given by users, limited to
+// public addresses unless internal is set.
+func newOutboundClient(timeout time.Duration, internal bool) *http.Client {
+	if internal {
+		return &http.Client{Timeout: timeout}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Dial: dialPublic},
+	}
+}
+
+// checkOutboundUrl checks that a url given by user is an http or https url
+// that user may have requests sent to.
+func checkOutboundUrl(s string, user *apiUser) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https url")
+	}
+	if user.Admin {
+		return nil
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	}
+	_, err = publicIPs(host)
+	return err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FILE_CONTENT      = "content"
+	FILE_PAR2_INDEX   = "par2"
+	FILE_PAR2_VOLUMES = "par2vol"
+	FILE_NFO          = "nfo"
+	FILE_OTHER        = "other"
+)
+
+var par2VolumeRe = regexp.MustCompile(`(?i)\.vol(\d+)[+-](\d+)\.par2$`)
+
+// Extensions of files that come along with a release but aren't part of it.
+var otherExtensions = map[string]bool{
+	"jpg": true, "jpeg": true, "png": true, "gif": true, "txt": true,
+	"url": true, "nzb": true, "md5": true, "db": true, "htm": true, "html": true,
+}
+
+func isPar2(name string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(name, ".")), ".par2")
+}
+
+// par2Volume reports whether name is a par2 recovery volume, and if so how
+// many recovery blocks it holds.
+func par2Volume(name string) (int, bool) {
+	m := par2VolumeRe.FindStringSubmatch(strings.TrimSuffix(name, "."))
+	if m == nil {
+		return 0, false
+	}
+	blocks, _ := strconv.Atoi(m[2])
+	return blocks, true
+}
+
+// par2SetName returns the lowercased name a par2 file protects, e.g.
+// "show - 05.mkv" for "Show - 05.mkv.vol03+04.par2".
+func par2SetName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if loc := par2VolumeRe.FindStringIndex(name); loc != nil {
+		return name[:loc[0]]
+	}
+	return strings.TrimSuffix(name, ".par2")
+}
+
+// classifyFile sorts a file into content, par2 index, par2 volumes,
+// nfo/sfv or other files.
+func classifyFile(name string) string {
+	if _, ok := par2Volume(name); ok {
+		return FILE_PAR2_VOLUMES
+	}
+	if isPar2(name) {
+		return FILE_PAR2_INDEX
+	}
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(strings.TrimSuffix(name, "."))), ".")
+	switch {
+	case ext == "nfo" || ext == "sfv":
+		return FILE_NFO
+	case otherExtensions[ext]:
+		return FILE_OTHER
+	}
+	return FILE_CONTENT
+}
+
+// fileBreakdown totals the files of an upload by class.
+type fileBreakdown struct {
+	ContentBytes  int64
+	RecoveryBytes int64
+	Par2Index     int
+	Par2Volumes   int
+	Par2Blocks    int
+	Nfo           int
+	Other         int
+	// Number of content files per extension.
+	Content map[string]int
+}
+
+func (b *fileBreakdown) add(name string, size int64) {
+	if b.Content == nil {
+		b.Content = make(map[string]int)
+	}
+	switch classifyFile(name) {
+	case FILE_PAR2_VOLUMES:
+		blocks, _ := par2Volume(name)
+		b.Par2Volumes++
+		b.Par2Blocks += blocks
+		b.RecoveryBytes += size
+	case FILE_PAR2_INDEX:
+		b.Par2Index++
+		b.RecoveryBytes += size
+	case FILE_NFO:
+		b.Nfo++
+	case FILE_OTHER:
+		b.Other++
+	default:
+		ext := strings.TrimPrefix(strings.ToLower(path.Ext(strings.TrimSuffix(name, "."))), ".")
+		if ext == "" {
+			ext = "file"
+		}
+		b.Content[ext]++
+		b.ContentBytes += size
+	}
+}
+
+// summary describes the files, e.g. "12 mkv, 1 nfo, 1 par2 (+24 vol)".
+func (b *fileBreakdown) summary() string {
+	exts := make([]string, 0, len(b.Content))
+	for ext := range b.Content {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	parts := make([]string, 0, len(exts)+3)
+	for _, ext := range exts {
+		parts = append(parts, strconv.Itoa(b.Content[ext])+" "+ext)
+	}
+	if b.Nfo > 0 {
+		parts = append(parts, strconv.Itoa(b.Nfo)+" nfo/sfv")
+	}
+	if b.Other > 0 {
+		parts = append(parts, strconv.Itoa(b.Other)+" other")
+	}
+	if b.Par2Index > 0 || b.Par2Volumes > 0 {
+		par2 := strconv.Itoa(b.Par2Index) + " par2"
+		if b.Par2Volumes > 0 {
+			par2 += " (+" + strconv.Itoa(b.Par2Volumes) + " vol)"
+		}
+		parts = append(parts, par2)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// getFileBreakdowns fetches the names and sizes of every file of the given
+// uploads and totals them by class.
+func getFileBreakdowns(ctx *context, uploads []string) map[string]*fileBreakdown {
+	breakdowns := make(map[string]*fileBreakdown, len(uploads))
+	if len(uploads) == 0 {
+		return breakdowns
+	}
+	query := map[string]interface{}{
+		"filter": map[string]interface{}{
+			"terms": map[string]interface{}{
+				"_routing": uploads,
+			},
+		},
+		"fields": []string{"_routing", "filename", "size"},
+		"size":   65536,
+	}
+	var esResp struct {
+		Hits struct {
+			Hits []struct {
+				Routing string `json:"_routing"`
+				Fields  struct {
+					Routing  string   `json:"_routing"`
+					Filename []string `json:"filename"`
+					Size     []int64  `json:"size"`
+				} `json:"fields"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/file/_search", query, &esResp); err != nil {
+		panic(err)
+	}
+	for _, hit := range esResp.Hits.Hits {
+		routing := hit.Routing
+		if routing == "" {
+			routing = hit.Fields.Routing
+		}
+		if len(hit.Fields.Filename) == 0 || len(hit.Fields.Size) == 0 {
+			continue
+		}
+		b, ok := breakdowns[routing]
+		if !ok {
+			b = &fileBreakdown{}
+			breakdowns[routing] = b
+		}
+		b.add(hit.Fields.Filename[0], hit.Fields.Size[0])
+	}
+	return breakdowns
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"net/http"
+)
+
+// posterProfile sums up the uploads of a poster.
+type posterProfile struct {
+	Name string `json:"name"`
+	uploadStats
+	Latest []uploadSummary `json:"latest"`
+	Links  struct {
+		Page string `json:"page"`
+		Rss  string `json:"rss"`
+	} `json:"links"`
+}
+
+// getPosterProfile serves the profile page of a poster, as html or, with
+// format=json, as json.
+func getPosterProfile(ctx *context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	name := params["name"]
+	if ctx.Blacklist.posterBlocked(name) {
+		jsonError(res, 410, "poster has been blacklisted")
+		return
+	}
+	p := posterProfile{
+		Name: name,
+		uploadStats: aggregateUploads(ctx, map[string]interface{}{
+			"constant_score": map[string]interface{}{
+				"filter": posterFilter(name),
+			},
+		}),
+	}
+	if p.Uploads == 0 {
+		jsonError(res, 404, "no uploads by this poster")
+		return
+	}
+	page, err := searchBackend(ctx, searchOptions{
+		Query:  "*",
+		Length: browseUploads,
+		Poster: name,
+	})
+	if err != nil {
+		jsonError(res, 400, err.Error())
+		return
+	}
+	urls := ctx.urls(req)
+	p.Latest = summarizeUploads(urls, page.Results)
+	p.Links.Page = urls.Abs("/poster/" + urlPath(name))
+	p.Links.Rss = urls.Abs("/rss/poster/" + urlPath(name))
+
+	if wantsJson(req) {
+		writeJson(res, 200, p)
+		return
+	}
+	res.Header().Set("Content-Type", "text/html")
+	renderTemplate(res, "poster.html", struct {
+		posterProfile
+		Base    string
+		UrlPath func(string) string
+	}{p, urls.Prefix, urlPath})
+}
+
+// posterFeed serves the uploads of a poster as a feed, in any of the
+// formats of genrss.
+func posterFeed(ctx *context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	name := params["name"]
+	if ctx.Blacklist.posterBlocked(name) {
+		jsonError(res, 410, "poster has been blacklisted")
+		return
+	}
+	req.ParseForm()
+	req.Form.Set("q", "*")
+	req.Form.Set("poster", name)
+	genrss(ctx, res, req)
+}
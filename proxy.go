@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks allowed to tell us the client address
+// through X-Forwarded-For.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDR
+// ranges.
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+func (t trustedProxies) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the address of the client, walking X-Forwarded-For
+// back through trusted proxies only, so clients can't pick their own.
+func (t trustedProxies) clientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if t.trusted(ip) {
+		hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !t.trusted(hop) {
+				break
+			}
+		}
+	}
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	return ip.String()
+}
+
+// forwarded returns the parameters of the last element of the Forwarded
+// header, the one added by the proxy closest to us.
+func forwarded(req *http.Request) map[string]string {
+	params := make(map[string]string)
+	elems := strings.Split(strings.Join(req.Header["Forwarded"], ","), ",")
+	last := strings.TrimSpace(elems[len(elems)-1])
+	for _, pair := range strings.Split(last, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], "\"")
+		}
+	}
+	return params
+}
+
+func lastHeaderValue(req *http.Request, name string) string {
+	values := strings.Split(strings.Join(req.Header[name], ","), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+// scheme returns the scheme the client used, as reported by a trusted
+// proxy through Forwarded, X-Forwarded-Proto or the older X-SSL.
+func (t trustedProxies) scheme(req *http.Request) string {
+	if t.trusted(remoteIP(req)) {
+		if proto := strings.ToLower(forwarded(req)["proto"]); proto == "http" || proto == "https" {
+			return proto
+		}
+		if proto := strings.ToLower(lastHeaderValue(req, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			return proto
+		}
+		if req.Header.Get("X-SSL") == "true" {
+			return "https"
+		}
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// host returns the host the client asked for, as reported by a trusted
+// proxy through Forwarded or X-Forwarded-Host.
+func (t trustedProxies) host(req *http.Request) string {
+	if t.trusted(remoteIP(req)) {
+		if host := forwarded(req)["host"]; host != "" {
+			return host
+		}
+		if host := lastHeaderValue(req, "X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return req.Host
+}
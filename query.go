@@ -0,0 +1,463 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Longest query accepted, in bytes.
+	maxQueryLength = 512
+	// Most terms a query may have.
+	maxQueryTerms = 16
+	// Letters a prefix search needs before its *.
+	minPrefixLength = 3
+	// Terms a prefix search expands to at most.
+	maxPrefixExpansions = 50
+)
+
+// Fields a query may name, by the names it may use for them.
+var queryFields = map[string]string{
+	"filename": "filename",
+	"name":     "filename",
+	"subject":  "subject",
+	"poster":   "poster",
+	"group":    "group",
+	"ext":      "ext",
+	"size":     "size",
+	"age":      "age",
+	// Used by the alternatives links of results.
+	"fingerprint": "fingerprint",
+}
+
+// Fields searched by terms that don't name one.
+var queryTextFields = []string{"filename", "subject", "poster"}
+
+var (
+	queryExtRe  = regexp.MustCompile(`^[a-z0-9]{1,8}$`)
+	querySizeRe = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([kmgt]i?b?|b)?$`)
+	queryAgeRe  = regexp.MustCompile(`(?i)^(\d+)\s*(m|h|d|w|y)$`)
+)
+
+var querySizeUnits = map[byte]ByteSize{
+	'b': 1,
+	'k': KB,
+	'm': MB,
+	'g': GB,
+	't': TB,
+}
+
+var queryAgeUnits = map[string]time.Duration{
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+// querySyntaxError points at what is wrong with a search query.
+type querySyntaxError struct {
+	Query string
+	// Byte offset of the problem in Query.
+	Pos int
+	Msg string
+}
+
+func (e *querySyntaxError) Error() string {
+	return fmt.Sprintf("%s at column %d", e.Msg, utf8.RuneCountInString(e.Query[:e.Pos])+1)
+}
+
+type queryTerm struct {
+	// One of queryFields, or "" for text.
+	Field  string
+	Value  string
+	Phrase bool
+	// Ends in a *.
+	Prefix bool
+	Negate bool
+	// Comparison of size and age terms: <, <=, > or >=.
+	Op string
+	// Parsed values of size, in bytes, and age.
+	Bytes int64
+	Age   time.Duration
+}
+
+// parsedQuery is a search query in the animezb query language: words,
+// "quoted phrases", -excluded terms and field:value terms, all of which
+// have to match.
+type parsedQuery struct {
+	Terms []queryTerm
+}
+
+// parseQuery parses a query typed into the search box. A query of just *
+// matches everything.
+func parseQuery(q string) (*parsedQuery, error) {
+	p := &parsedQuery{Terms: make([]queryTerm, 0, 4)}
+	if len(q) > maxQueryLength {
+		return nil, &querySyntaxError{q, maxQueryLength, fmt.Sprintf("query is longer than %d characters", maxQueryLength)}
+	}
+	if strings.TrimSpace(q) == "*" {
+		return p, nil
+	}
+	for i := 0; i < len(q); {
+		if q[i] == ' ' || q[i] == '\t' || q[i] == '\n' || q[i] == '\r' {
+			i++
+			continue
+		}
+		start := i
+		var t queryTerm
+		if q[i] == '-' && i+1 < len(q) && q[i+1] != ' ' {
+			t.Negate = true
+			i++
+		}
+		// field:value, if what is before the colon is a field name.
+		if j := strings.IndexAny(q[i:], ": \""); j > 0 && q[i+j] == ':' {
+			name := strings.ToLower(q[i : i+j])
+			if field, ok := queryFields[name]; ok {
+				t.Field = field
+				i += j + 1
+			} else if guess := guessField(name); guess != "" {
+				return nil, &querySyntaxError{q, i, fmt.Sprintf("unknown field %s:, did you mean %s:?", name, guess)}
+			}
+		}
+		valueStart := i
+		if i < len(q) && q[i] == '"' {
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, &querySyntaxError{q, i, "phrase is missing its closing quote"}
+			}
+			t.Value = strings.TrimSpace(q[i+1 : i+1+end])
+			t.Phrase = true
+			i += end + 2
+			if t.Value == "" {
+				return nil, &querySyntaxError{q, valueStart, "empty phrase"}
+			}
+		} else {
+			end := strings.IndexAny(q[i:], " \t\n\r")
+			if end < 0 {
+				end = len(q) - i
+			}
+			t.Value = q[i : i+end]
+			i += end
+		}
+		if t.Value == "" {
+			return nil, &querySyntaxError{q, start, fmt.Sprintf("missing value after %s:", t.Field)}
+		}
+		if t.Field == "" && !t.Phrase && !t.Negate {
+			switch t.Value {
+			case "AND":
+				// Terms always have to match, AND is what happens anyway.
+				continue
+			case "OR", "NOT", "&&", "||":
+				return nil, &querySyntaxError{q, start, fmt.Sprintf("%s isn't supported, every term has to match; use -word to exclude one", t.Value)}
+			}
+		}
+		if err := t.parseValue(); err != "" {
+			return nil, &querySyntaxError{q, valueStart, err}
+		}
+		if t.Field == "" && !t.Phrase && !hasLetterOrDigit(t.Value) {
+			// Punctuation on its own doesn't match anything.
+			continue
+		}
+		if len(p.Terms) == maxQueryTerms {
+			return nil, &querySyntaxError{q, start, fmt.Sprintf("queries can't have more than %d terms", maxQueryTerms)}
+		}
+		p.Terms = append(p.Terms, t)
+	}
+	return p, nil
+}
+
+// migrateQuery rewrites a query in the query_string syntax searches were
+// saved with before: +word and && are dropped, as every term has to match,
+// and !word and NOT word become -word. OR and groups can't be rewritten.
+func migrateQuery(q string) string {
+	words := strings.Fields(q)
+	migrated := make([]string, 0, len(words))
+	negate := false
+	for _, w := range words {
+		switch {
+		case w == "&&":
+			continue
+		case w == "NOT":
+			negate = true
+			continue
+		case len(w) > 1 && (w[0] == '+' || w[0] == '!'):
+			if w[0] == '!' {
+				negate = true
+			}
+			w = w[1:]
+		}
+		if negate {
+			w = "-" + w
+			negate = false
+		}
+		migrated = append(migrated, w)
+	}
+	return strings.Join(migrated, " ")
+}
+
+// guessField returns the field name a mistyped one was likely meant to be.
+func guessField(name string) string {
+	if len(name) < 3 {
+		return ""
+	}
+	for alias := range queryFields {
+		if editDistance([]rune(name), []rune(alias)) == 1 {
+			return alias
+		}
+	}
+	return ""
+}
+
+func hasLetterOrDigit(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseValue checks the value of a term against its field, returning what
+// is wrong with it.
+func (t *queryTerm) parseValue() string {
+	if t.Field == "size" || t.Field == "age" {
+		for _, op := range []string{">=", "<=", ">", "<"} {
+			if strings.HasPrefix(t.Value, op) {
+				t.Op = op
+				break
+			}
+		}
+		if t.Op == "" {
+			return fmt.Sprintf("%s: needs a comparison, like %s", t.Field, map[string]string{"size": "size:>700MB", "age": "age:<7d"}[t.Field])
+		}
+	}
+	value := strings.TrimSpace(strings.TrimPrefix(t.Value, t.Op))
+	switch t.Field {
+	case "size":
+		m := querySizeRe.FindStringSubmatch(value)
+		if m == nil {
+			return "size: needs a size like 700MB or 1.5GB"
+		}
+		n, _ := strconv.ParseFloat(m[1], 64)
+		unit := ByteSize(1)
+		if m[2] != "" {
+			unit = querySizeUnits[strings.ToLower(m[2])[0]]
+		}
+		t.Bytes = int64(n * float64(unit))
+	case "age":
+		m := queryAgeRe.FindStringSubmatch(value)
+		if m == nil {
+			return "age: needs an age like 90m, 12h, 7d, 2w or 1y"
+		}
+		n, _ := strconv.Atoi(m[1])
+		t.Age = time.Duration(n) * queryAgeUnits[strings.ToLower(m[2])]
+	case "fingerprint":
+		// Matched exactly.
+	case "ext":
+		t.Value = strings.ToLower(strings.TrimPrefix(t.Value, "."))
+		if !queryExtRe.MatchString(t.Value) {
+			return "ext: needs a file extension like mkv"
+		}
+	default:
+		star := strings.IndexByte(t.Value, '*')
+		if star < 0 {
+			break
+		}
+		if star != len(t.Value)-1 {
+			return "* is only allowed at the end of a word"
+		}
+		if t.Phrase {
+			return "* isn't allowed in a phrase"
+		}
+		t.Value = strings.TrimSuffix(t.Value, "*")
+		t.Prefix = true
+		if utf8.RuneCountInString(t.Value) < minPrefixLength {
+			return fmt.Sprintf("* needs at least %d letters before it", minPrefixLength)
+		}
+	}
+	return ""
+}
+
+// quotePhrase quotes s as a phrase. Phrases can't have quotes in them, so
+// they are dropped.
+func quotePhrase(s string) string {
+	return `"` + strings.Replace(s, `"`, "", -1) + `"`
+}
+
+// newsgroup expands the a.b. shorthand of a newsgroup name.
+func newsgroup(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "a.b.") {
+		return "alt.binaries." + strings.TrimPrefix(name, "a.b.")
+	}
+	return name
+}
+
+// clause is the ES query, or filter, a term compiles to.
+func (t *queryTerm) clause() (clause map[string]interface{}, filter bool) {
+	matchType := "phrase"
+	if t.Prefix {
+		matchType = "phrase_prefix"
+	} else if !t.Phrase {
+		matchType = "boolean"
+	}
+	switch t.Field {
+	case "":
+		multiType := matchType
+		if multiType == "boolean" {
+			multiType = "best_fields"
+		}
+		return map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":          t.Value,
+				"fields":         queryTextFields,
+				"type":           multiType,
+				"operator":       "and",
+				"max_expansions": maxPrefixExpansions,
+			},
+		}, false
+	case "group":
+		// Newsgroups have dots in their names, release groups rarely do.
+		if strings.Contains(t.Value, ".") {
+			return map[string]interface{}{
+				"query": map[string]interface{}{
+					"match": map[string]interface{}{
+						"group": map[string]interface{}{
+							"query": newsgroup(t.Value),
+							"type":  matchType,
+						},
+					},
+				},
+			}, true
+		}
+		return map[string]interface{}{
+			"match": map[string]interface{}{
+				"filename": map[string]interface{}{
+					"query": t.Value,
+					"type":  "phrase",
+				},
+			},
+		}, false
+	case "fingerprint":
+		return map[string]interface{}{
+			"term": map[string]interface{}{
+				"fingerprint": t.Value,
+			},
+		}, true
+	case "ext":
+		return map[string]interface{}{
+			"exists": map[string]interface{}{
+				"field": "types." + t.Value,
+			},
+		}, true
+	case "size":
+		return map[string]interface{}{
+			"range": map[string]interface{}{
+				"size": map[string]interface{}{
+					map[string]string{">": "gt", ">=": "gte", "<": "lt", "<=": "lte"}[t.Op]: t.Bytes,
+				},
+			},
+		}, true
+	case "age":
+		// Younger than an age is newer than a date.
+		return map[string]interface{}{
+			"range": map[string]interface{}{
+				"date": map[string]interface{}{
+					map[string]string{">": "lt", ">=": "lte", "<": "gt", "<=": "gte"}[t.Op]: time.Now().Add(-t.Age).Format(time.RFC3339),
+				},
+			},
+		}, true
+	}
+	return map[string]interface{}{
+		"match": map[string]interface{}{
+			t.Field: map[string]interface{}{
+				"query":          t.Value,
+				"type":           matchType,
+				"operator":       "and",
+				"max_expansions": maxPrefixExpansions,
+			},
+		},
+	}, false
+}
+
+// compile turns the query into an ES query and the filters to go with it.
+// Runs of words that name a known anime match any of its titles.
+func (p *parsedQuery) compile(ti *titleIndex) (map[string]interface{}, []interface{}) {
+	must := make([]interface{}, 0, len(p.Terms))
+	mustNot := make([]interface{}, 0, 2)
+	filters := make([]interface{}, 0, 2)
+
+	// Only words on their own can be part of a title.
+	words := make([]string, len(p.Terms))
+	for i, t := range p.Terms {
+		if t.Field == "" && !t.Phrase && !t.Prefix && !t.Negate {
+			if norm := normalizeTitle(t.Value); !strings.Contains(norm, " ") {
+				words[i] = norm
+			}
+		}
+	}
+	runs := make(map[int]titleRun)
+	for i := 0; i < len(words); {
+		j := i
+		for j < len(words) && words[j] != "" {
+			j++
+		}
+		for _, run := range ti.expandWords(words[i:j]) {
+			run.Start, run.End = run.Start+i, run.End+i
+			runs[run.Start] = run
+		}
+		i = j + 1
+	}
+
+	for i := 0; i < len(p.Terms); i++ {
+		if run, ok := runs[i]; ok {
+			should := make([]interface{}, 0, len(run.Aliases))
+			for _, alias := range run.Aliases {
+				should = append(should, map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":  alias,
+						"fields": queryTextFields,
+						"type":   "phrase",
+					},
+				})
+			}
+			must = append(must, map[string]interface{}{
+				"bool": map[string]interface{}{
+					"should":               should,
+					"minimum_should_match": 1,
+				},
+			})
+			i = run.End - 1
+			continue
+		}
+		t := p.Terms[i]
+		clause, filter := t.clause()
+		switch {
+		case filter && t.Negate:
+			filters = append(filters, map[string]interface{}{"not": clause})
+		case filter:
+			filters = append(filters, clause)
+		case t.Negate:
+			mustNot = append(mustNot, clause)
+		default:
+			must = append(must, clause)
+		}
+	}
+	if len(must) == 0 {
+		must = append(must, map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		})
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":     must,
+			"must_not": mustNot,
+		},
+	}, filters
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTitleIndex imports a titles dump written to a temporary file.
+func testTitleIndex(t *testing.T, dump string) *titleIndex {
+	dir, err := ioutil.TempDir("", "titles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "anime-titles.dat")
+	if err := ioutil.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ti := newTitleIndex()
+	if _, err := ti.importTitles(path); err != nil {
+		t.Fatal(err)
+	}
+	return ti
+}
+
+func TestParseQueryRejects(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"postr:foo", "unknown field postr:, did you mean poster:? at column 1"},
+		{"foo sze:>1GB", "unknown field sze:, did you mean size:? at column 5"},
+		{"foo OR bar", "OR isn't supported, every term has to match; use -word to exclude one at column 5"},
+		{"NOT foo", "NOT isn't supported"},
+		{"foo && bar", "&& isn't supported"},
+		{"foo || bar", "|| isn't supported"},
+		{"fo*", "* needs at least 3 letters before it at column 1"},
+		{"subject:fo*", "* needs at least 3 letters before it at column 9"},
+		{"f*oo", "* is only allowed at the end of a word"},
+		{`"foo bar*"`, "* isn't allowed in a phrase"},
+		{`foo "bar`, "phrase is missing its closing quote at column 5"},
+		{`""`, "empty phrase"},
+		{"poster:", "missing value after poster:"},
+		{"size:700MB", "size: needs a comparison, like size:>700MB"},
+		{"size:>lots", "size: needs a size like 700MB or 1.5GB"},
+		{"age:7d", "age: needs a comparison, like age:<7d"},
+		{"age:<7x", "age: needs an age like 90m, 12h, 7d, 2w or 1y"},
+		{"ext:m.kv", "ext: needs a file extension like mkv"},
+		{strings.Repeat("a ", maxQueryTerms) + "a", "queries can't have more than 16 terms at column 33"},
+		{strings.Repeat("a", maxQueryLength+1), "query is longer than 512 characters"},
+	}
+	for _, test := range tests {
+		p, err := parseQuery(test.query)
+		if err == nil {
+			t.Errorf("parseQuery(%q) = %+v, want error %q", test.query, p, test.err)
+			continue
+		}
+		if _, ok := err.(*querySyntaxError); !ok {
+			t.Errorf("parseQuery(%q) error %T, want *querySyntaxError", test.query, err)
+		}
+		if !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("parseQuery(%q) error %q, want %q", test.query, err, test.err)
+		}
+	}
+}
+
+func TestParseQueryAccepts(t *testing.T) {
+	tests := []struct {
+		query string
+		terms []queryTerm
+	}{
+		{"*", nil},
+		{" * ", nil},
+		{"foo AND bar", []queryTerm{{Value: "foo"}, {Value: "bar"}}},
+		{"foo - !", []queryTerm{{Value: "foo"}}},
+		{`-"foo bar" baz*`, []queryTerm{
+			{Value: "foo bar", Phrase: true, Negate: true},
+			{Value: "baz", Prefix: true},
+		}},
+		{"Poster:Someone name:ep01", []queryTerm{
+			{Field: "poster", Value: "Someone"},
+			{Field: "filename", Value: "ep01"},
+		}},
+		{"notafield:foo", []queryTerm{{Value: "notafield:foo"}}},
+		{"ext:.MKV", []queryTerm{{Field: "ext", Value: "mkv"}}},
+		{"size:>=1.5GB size:<700mib", []queryTerm{
+			{Field: "size", Value: ">=1.5GB", Op: ">=", Bytes: int64(1.5 * float64(GB))},
+			{Field: "size", Value: "<700mib", Op: "<", Bytes: int64(700 * MB)},
+		}},
+		{"-age:>2w", []queryTerm{{Field: "age", Value: ">2w", Op: ">", Negate: true, Age: 14 * 24 * time.Hour}}},
+	}
+	most := make([]queryTerm, maxQueryTerms)
+	for i := range most {
+		most[i].Value = "a"
+	}
+	tests = append(tests, struct {
+		query string
+		terms []queryTerm
+	}{strings.Repeat("a ", maxQueryTerms), most})
+	for _, test := range tests {
+		p, err := parseQuery(test.query)
+		if err != nil {
+			t.Errorf("parseQuery(%q) error %q", test.query, err)
+			continue
+		}
+		if len(p.Terms) != len(test.terms) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", test.query, p.Terms, test.terms)
+			continue
+		}
+		for i := range p.Terms {
+			if p.Terms[i] != test.terms[i] {
+				t.Errorf("parseQuery(%q) term %d = %+v, want %+v", test.query, i, p.Terms[i], test.terms[i])
+			}
+		}
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	ti := testTitleIndex(t, "1|1|x-jat|Shingeki no Kyojin\n1|4|en|Attack on Titan\n")
+	text := func(value string, matchType string) map[string]interface{} {
+		return map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":          value,
+				"fields":         queryTextFields,
+				"type":           matchType,
+				"operator":       "and",
+				"max_expansions": maxPrefixExpansions,
+			},
+		}
+	}
+	alias := func(value string) map[string]interface{} {
+		return map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":  value,
+				"fields": queryTextFields,
+				"type":   "phrase",
+			},
+		}
+	}
+	tests := []struct {
+		query   string
+		must    []interface{}
+		mustNot []interface{}
+		filters []interface{}
+	}{
+		{"*", []interface{}{map[string]interface{}{"match_all": map[string]interface{}{}}}, nil, nil},
+		{`foo -bar "baz qux" abc*`, []interface{}{
+			text("foo", "best_fields"),
+			text("baz qux", "phrase"),
+			text("abc", "phrase_prefix"),
+		}, []interface{}{text("bar", "best_fields")}, nil},
+		{"Attack on Titan 1080p", []interface{}{
+			map[string]interface{}{
+				"bool": map[string]interface{}{
+					"should":               []interface{}{alias("attack on titan"), alias("shingeki no kyojin")},
+					"minimum_should_match": 1,
+				},
+			},
+			text("1080p", "best_fields"),
+		}, nil, nil},
+		{`"attack on titan"`, []interface{}{text("attack on titan", "phrase")}, nil, nil},
+		{"poster:someone group:horriblesubs", []interface{}{
+			map[string]interface{}{
+				"match": map[string]interface{}{
+					"poster": map[string]interface{}{
+						"query":          "someone",
+						"type":           "boolean",
+						"operator":       "and",
+						"max_expansions": maxPrefixExpansions,
+					},
+				},
+			},
+			map[string]interface{}{
+				"match": map[string]interface{}{
+					"filename": map[string]interface{}{
+						"query": "horriblesubs",
+						"type":  "phrase",
+					},
+				},
+			},
+		}, nil, nil},
+		{"ext:mkv -size:>1GB group:a.b.anime fingerprint:abc", []interface{}{
+			map[string]interface{}{"match_all": map[string]interface{}{}},
+		}, nil, []interface{}{
+			map[string]interface{}{
+				"exists": map[string]interface{}{"field": "types.mkv"},
+			},
+			map[string]interface{}{
+				"not": map[string]interface{}{
+					"range": map[string]interface{}{
+						"size": map[string]interface{}{"gt": int64(GB)},
+					},
+				},
+			},
+			map[string]interface{}{
+				"query": map[string]interface{}{
+					"match": map[string]interface{}{
+						"group": map[string]interface{}{
+							"query": "alt.binaries.anime",
+							"type":  "boolean",
+						},
+					},
+				},
+			},
+			map[string]interface{}{
+				"term": map[string]interface{}{"fingerprint": "abc"},
+			},
+		}},
+	}
+	for _, test := range tests {
+		p, err := parseQuery(test.query)
+		if err != nil {
+			t.Errorf("parseQuery(%q) error %q", test.query, err)
+			continue
+		}
+		query, filters := p.compile(ti)
+		if test.mustNot == nil {
+			test.mustNot = []interface{}{}
+		}
+		if test.filters == nil {
+			test.filters = []interface{}{}
+		}
+		want := map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":     test.must,
+				"must_not": test.mustNot,
+			},
+		}
+		if got, want := marshalTest(t, query), marshalTest(t, want); got != want {
+			t.Errorf("query of %q =\n%s\nwant\n%s", test.query, got, want)
+		}
+		if got, want := marshalTest(t, filters), marshalTest(t, test.filters); got != want {
+			t.Errorf("filters of %q =\n%s\nwant\n%s", test.query, got, want)
+		}
+	}
+}
+
+func marshalTest(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LIMIT_SEARCH = "search"
+	LIMIT_RSS    = "rss"
+	LIMIT_NZB    = "nzb"
+
+	// Tier of clients without an api key, limited per address.
+	TIER_ANONYMOUS = "ip"
+
+	// Newznab error codes.
+	NEWZNAB_REQUEST_LIMIT  = 500
+	NEWZNAB_DOWNLOAD_LIMIT = 501
+)
+
+// rateLimit is a token bucket, Rate tokens per second up to Burst. A zero
+// Rate is unlimited.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Limits of each tier, used unless the -ratelimits file overrides them.
+var defaultRateLimits = map[string]map[string]rateLimit{
+	TIER_ANONYMOUS: {
+		LIMIT_SEARCH: {30.0 / 60, 30},
+		LIMIT_RSS:    {10.0 / 60, 10},
+		LIMIT_NZB:    {60.0 / 60, 60},
+	},
+	"default": {
+		LIMIT_SEARCH: {120.0 / 60, 60},
+		LIMIT_RSS:    {60.0 / 60, 30},
+		LIMIT_NZB:    {300.0 / 60, 150},
+	},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token, returning how long to wait for one if the bucket
+// is empty.
+func (b *tokenBucket) take(limit rateLimit, now time.Time) time.Duration {
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	limits  map[string]map[string]rateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		limits:  defaultRateLimits,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func parseRate(s string) (float64, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	per := time.Second
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		case "d":
+			per = 24 * time.Hour
+		default:
+			return 0, fmt.Errorf("invalid rate %q", s)
+		}
+	}
+	return n / per.Seconds(), nil
+}
+
+// load reads rate limits from path, one per line:
+//
+//	<tier> <search|rss|nzb|*> <rate> [burst]
+//
+// The rate is a number per s, m, h or d, such as 30/m, or 0 for no limit.
+// The burst defaults to a minute's worth of requests. Tier ip applies to
+// clients without an api key. Limits not in the file keep their defaults.
+func (l *rateLimiter) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	limits := make(map[string]map[string]rateLimit)
+	for tier, classes := range defaultRateLimits {
+		limits[tier] = make(map[string]rateLimit)
+		for class, limit := range classes {
+			limits[tier][class] = limit
+		}
+	}
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return 0, fmt.Errorf("%s:%d: expected tier, class and rate", path, line)
+		}
+		var limit rateLimit
+		if limit.Rate, err = parseRate(fields[2]); err != nil {
+			return 0, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		limit.Burst = math.Max(1, limit.Rate*60)
+		if len(fields) > 3 {
+			if limit.Burst, err = strconv.ParseFloat(fields[3], 64); err != nil || limit.Burst < 1 {
+				return 0, fmt.Errorf("%s:%d: invalid burst %q", path, line, fields[3])
+			}
+		}
+		classes := []string{fields[1]}
+		switch fields[1] {
+		case "*":
+			classes = []string{LIMIT_SEARCH, LIMIT_RSS, LIMIT_NZB}
+		case LIMIT_SEARCH, LIMIT_RSS, LIMIT_NZB:
+		default:
+			return 0, fmt.Errorf("%s:%d: unknown class %q", path, line, fields[1])
+		}
+		if limits[fields[0]] == nil {
+			limits[fields[0]] = make(map[string]rateLimit)
+		}
+		for _, class := range classes {
+			limits[fields[0]][class] = limit
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	l.Lock()
+	l.limits = limits
+	l.Unlock()
+	return n, nil
+}
+
+// limit returns the limit of a tier, falling back to the default tier for
+// keys whose tier isn't configured.
+func (l *rateLimiter) limit(tier string, class string) rateLimit {
+	if limit, ok := l.limits[tier][class]; ok {
+		return limit
+	}
+	if tier != TIER_ANONYMOUS {
+		if limit, ok := l.limits["default"][class]; ok {
+			return limit
+		}
+	}
+	return l.limits[TIER_ANONYMOUS][class]
+}
+
+// allow takes a token from the client's bucket for class.
+func (l *rateLimiter) allow(class string, tier string, client string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	limit := l.limit(tier, class)
+	if limit.Rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	k := class + "|" + client
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &tokenBucket{tokens: limit.Burst, last: now}
+		l.buckets[k] = b
+	}
+	return b.take(limit, now)
+}
+
+// sweep forgets buckets that have been idle long enough to be full again.
+func (l *rateLimiter) sweep(idle time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	cutoff := time.Now().Add(-idle)
+	for k, b := range l.buckets {
+		if b.last.Before(cutoff) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func sweepRateLimits(l *rateLimiter, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		l.sweep(time.Hour)
+	}
+}
+
+// limitRequests returns a handler limiting requests to the class budget,
+// per api key when the request has a valid one and per address otherwise.
+// Limited requests get a 429 with Retry-After, and on the feed and nzb
+// routes, which indexer managers use, a Newznab error.
+func limitRequests(class string) martini.Handler {
+	return func(ctx *context, res http.ResponseWriter, req *http.Request) (int, string) {
+		tier, client := TIER_ANONYMOUS, "ip:"+ctx.Proxies.clientIP(req)
+		if user := ctx.Keys.get(requestApiKey(req)); user != nil {
+			tier, client = user.Tier, "key:"+user.Key
+		}
+		wait := ctx.Limits.allow(class, tier, client)
+		if wait == 0 {
+			return 0, ""
+		}
+		retry := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+		res.Header().Set("Retry-After", retry)
+		switch class {
+		case LIMIT_RSS:
+			return 429, newznabError(res, NEWZNAB_REQUEST_LIMIT, "Request limit reached")
+		case LIMIT_NZB:
+			return 429, newznabError(res, NEWZNAB_DOWNLOAD_LIMIT, "Download limit reached")
+		}
+		res.Header().Set("Content-Type", "text/plain")
+		return 429, "Too many requests, try again in " + retry + " seconds."
+	}
+}
+
+func newznabError(res http.ResponseWriter, code int, description string) string {
+	res.Header().Set("Content-Type", "application/xml")
+	return fmt.Sprintf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<error code=\"%d\" description=\"%s\"/>\n", code, description)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Boosts of related uploads by the same poster and of the same series.
+	samePosterBoost = 2
+	sameSeriesBoost = 4
+	// Terms of the upload's filename and subject more_like_this looks for.
+	relatedQueryTerms = 25
+)
+
+// findRelated finds the uploads most like an upload, such as its other
+// episodes, resolutions and reposts. Uploads by the same poster and of the
+// same series rank higher.
+func findRelated(ctx *context, urls *urlBuilder, uploadId string, upload *uploadDoc) []relatedEntry {
+	related := make([]relatedEntry, 0, relatedUploads)
+	name := strings.TrimSuffix(upload.Filename, ".")
+	if upload.FilePrefix != "" {
+		name = strings.TrimSuffix(upload.FilePrefix, ".")
+	}
+	title := normalizeTitle(parseRelease(name).Title)
+
+	similar := []interface{}{
+		map[string]interface{}{
+			"more_like_this": map[string]interface{}{
+				"fields":               []string{"filename", "subject"},
+				"ids":                  []string{uploadId},
+				"min_term_freq":        1,
+				"min_doc_freq":         1,
+				"max_query_terms":      relatedQueryTerms,
+				"minimum_should_match": "30%",
+			},
+		},
+	}
+	if title != "" {
+		similar = append(similar, map[string]interface{}{
+			"match": map[string]interface{}{
+				"filename": map[string]interface{}{
+					"query": title,
+					"type":  "phrase",
+					"boost": sameSeriesBoost,
+				},
+			},
+		})
+	}
+	boosts := make([]interface{}, 0, 1)
+	if upload.Poster != "" {
+		boosts = append(boosts, map[string]interface{}{
+			"match": map[string]interface{}{
+				"poster": map[string]interface{}{
+					"query": upload.Poster,
+					"type":  "phrase",
+					"boost": samePosterBoost,
+				},
+			},
+		})
+	}
+	filters := append([]interface{}{
+		map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"hidden": true,
+				},
+			},
+		},
+		map[string]interface{}{
+			"not": map[string]interface{}{
+				"ids": map[string]interface{}{
+					"values": []string{uploadId},
+				},
+			},
+		},
+	}, blacklistFilters(ctx)...)
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"bool": map[string]interface{}{
+						"should":               similar,
+						"minimum_should_match": 1,
+					},
+				},
+				"should": boosts,
+			},
+		},
+		"filter": map[string]interface{}{
+			"and": filters,
+		},
+		// Room for uploads blacklisted by poster or subject.
+		"size":    relatedUploads * 2,
+		"_source": []string{"filename", "fileprefix", "poster", "subject", "date", "size", "complete", "length", "completion"},
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		panic(err)
+	}
+	for _, hit := range esResp.Hits.Hits {
+		var u uploadDoc
+		if json.Unmarshal(hit.Source, &u) != nil || ctx.Blacklist.blocked(hit.Id, u.Poster, u.Subject) {
+			continue
+		}
+		r := relatedEntry{
+			Id:      hit.Id,
+			Name:    strings.TrimSuffix(u.Filename, "."),
+			Poster:  u.Poster,
+			Size:    ByteSize(u.Size).String(),
+			Age:     formatAge(u.Date),
+			Details: urls.Abs("/upload/" + hit.Id),
+		}
+		if u.FilePrefix != "" {
+			r.Name = strings.TrimSuffix(u.FilePrefix, ".")
+		}
+		release := parseRelease(r.Name)
+		r.Group = release.Group
+		r.SamePoster = u.Poster == upload.Poster
+		r.SameSeries = title != "" && normalizeTitle(release.Title) == title
+		if u.Complete == u.Length {
+			r.Completion = "100%"
+		} else {
+			r.Completion = fmt.Sprintf("%0.2f%%", u.Completion*100)
+		}
+		related = append(related, r)
+		if len(related) == relatedUploads {
+			break
+		}
+	}
+	return related
+}
+
+// getRelatedUploads lists the uploads most like an upload.
+func getRelatedUploads(ctx *context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	uploadId := params["nzbid"]
+	upload, err := getUpload(ctx, uploadId)
+	if err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such upload")
+			return
+		}
+		panic(err)
+	}
+	writeJson(res, 200, findRelated(ctx, ctx.urls(req), uploadId, upload))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// releaseInfo is what can be learned about a release from its name, e.g.
+// "[HorribleSubs] Shingeki no Kyojin - 05 [720p].mkv".
+type releaseInfo struct {
+	Group      string `json:"group,omitempty"`
+	Title      string `json:"title"`
+	Episode    string `json:"episode,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Codec      string `json:"codec,omitempty"`
+	Crc32      string `json:"crc32,omitempty"`
+	Extension  string `json:"extension,omitempty"`
+}
+
+var (
+	releaseGroupRe      = regexp.MustCompile(`^\s*[\[(]([^\])]+)[\])]`)
+	releaseCrcRe        = regexp.MustCompile(`[\[(]([0-9A-Fa-f]{8})[\])]`)
+	releaseResolutionRe = regexp.MustCompile(`(?i)\b(\d{3,4}p|\d{3,4}x\d{3,4}|4k)\b`)
+	releaseSourceRe     = regexp.MustCompile(`(?i)\b(bd|bdrip|blu-?ray|dvd|dvdrip|tv|hdtv|web|web-?dl|webrip)\b`)
+	releaseCodecRe      = regexp.MustCompile(`(?i)\b(x264|h\.?264|avc|x265|h\.?265|hevc|xvid|10-?bit|hi10p?)\b`)
+	releaseEpisodeRe    = regexp.MustCompile(`(?i)(?:\s-\s|\s|_)(?:ep?|episode\s?)?(\d{1,4}(?:\.\d)?)(?:v(\d))?(?:\s|_|\[|\(|$|\.)`)
+	releaseSeasonEpRe   = regexp.MustCompile(`(?i)\bS\d{1,2}E(\d{1,4})(?:v(\d))?\b`)
+	releaseExtRe        = regexp.MustCompile(`^\.[A-Za-z0-9]{2,4}$`)
+)
+
+func parseRelease(name string) releaseInfo {
+	var r releaseInfo
+	name = strings.TrimSpace(strings.TrimSuffix(name, "."))
+	if ext := path.Ext(name); releaseExtRe.MatchString(ext) {
+		r.Extension = strings.ToLower(ext[1:])
+		name = strings.TrimSuffix(name, ext)
+	}
+	if m := releaseGroupRe.FindStringSubmatchIndex(name); m != nil {
+		r.Group = strings.TrimSpace(name[m[2]:m[3]])
+		name = name[m[1]:]
+	}
+	if m := releaseCrcRe.FindAllStringSubmatch(name, -1); m != nil {
+		r.Crc32 = strings.ToUpper(m[len(m)-1][1])
+	}
+	if m := releaseResolutionRe.FindStringSubmatch(name); m != nil {
+		r.Resolution = strings.ToLower(m[1])
+	}
+	if m := releaseSourceRe.FindStringSubmatch(name); m != nil {
+		r.Source = strings.ToUpper(m[1])
+	}
+	if m := releaseCodecRe.FindStringSubmatch(name); m != nil {
+		r.Codec = strings.ToLower(m[1])
+	}
+
+	// Everything up to the episode number, or the first tag, is the title.
+	title := name
+	if i := strings.IndexAny(title, "[("); i >= 0 {
+		title = title[:i]
+	}
+	title = strings.Replace(title, "_", " ", -1)
+	if strings.Count(title, ".") > 1 && !strings.Contains(title, " ") {
+		title = strings.Replace(title, ".", " ", -1)
+	}
+	if m := releaseSeasonEpRe.FindStringSubmatchIndex(title); m != nil {
+		r.Episode = title[m[2]:m[3]]
+		if m[4] >= 0 {
+			r.Version, _ = strconv.Atoi(title[m[4]:m[5]])
+		}
+		title = title[:m[0]]
+	} else if m := releaseEpisodeRe.FindAllStringSubmatchIndex(title+" ", -1); m != nil {
+		// The last number is the episode, "Mobile Suit Gundam 00 - 05".
+		last := m[len(m)-1]
+		r.Episode = title[last[2]:last[3]]
+		if last[4] >= 0 {
+			r.Version, _ = strconv.Atoi(title[last[4]:last[5]])
+		}
+		title = title[:last[0]]
+	}
+	title = strings.TrimSpace(title)
+	title = strings.TrimRight(title, " -_.")
+	r.Title = strings.TrimSpace(title)
+	return r
+}
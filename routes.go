@@ -6,17 +6,59 @@ import (
 
 func routes(m *martini.ClassicMartini) {
 
-	m.Get("/", search)
-	m.Get("/index", search)
-	m.Get("/index.html", search)
+	m.Get("/", limitRequests(LIMIT_SEARCH), search)
+	m.Get("/index", limitRequests(LIMIT_SEARCH), search)
+	m.Get("/index.html", limitRequests(LIMIT_SEARCH), search)
+	m.Get("/opensearch.xml", opensearchDescription)
+	m.Get("/suggest", limitRequests(LIMIT_SEARCH), opensearchSuggest)
+	m.Get("/api/v1/suggest", limitRequests(LIMIT_SEARCH), getSuggestions)
+	m.Get("/stats", limitRequests(LIMIT_SEARCH), statsPage)
+	m.Get("/api/v1/stats", limitRequests(LIMIT_SEARCH), getStats)
 
-	m.Get("/nzb/:nzbid/:nzbname", gennzb)
-	m.Get("/nzb/:nzbid", gennzb)
-	m.Post("/nzb", gennzb)
+	m.Get("/nzb/:nzbid/:nzbname", limitRequests(LIMIT_NZB), gennzb)
+	m.Get("/nzb/:nzbid", limitRequests(LIMIT_NZB), gennzb)
+	m.Post("/nzb", limitRequests(LIMIT_NZB), gennzb)
+	m.Post("/send", requireApiKey, limitRequests(LIMIT_NZB), sendToDownloader)
+	m.Get("/merge", limitRequests(LIMIT_NZB), previewMerge)
+	m.Post("/merge", limitRequests(LIMIT_NZB), previewMerge)
 
-	m.Get("/rss", genrss)
-	m.Get("/rss/", genrss)
-	m.Get("/uploads/:nzbid", getUploadInfo)
+	m.Get("/rss", limitRequests(LIMIT_RSS), genrss)
+	m.Get("/rss/", limitRequests(LIMIT_RSS), genrss)
+	m.Get("/rss/poster/:name", limitRequests(LIMIT_RSS), posterFeed)
+	m.Get("/rss/group/:name", limitRequests(LIMIT_RSS), groupFeed)
+	m.Get("/atom", limitRequests(LIMIT_RSS), genatom)
+	m.Get("/feed.json", limitRequests(LIMIT_RSS), genjsonfeed)
+	m.Get("/uploads/:nzbid", limitRequests(LIMIT_SEARCH), checkBlacklist, getUploadInfo)
+	m.Get("/upload/:nzbid", limitRequests(LIMIT_SEARCH), checkBlacklist, getUploadDetail)
+	m.Post("/uploads/:nzbid/check", requireApiKey, checkBlacklist, checkUploadAvailability)
+	m.Get("/uploads/:nzbid/duplicates", limitRequests(LIMIT_SEARCH), checkBlacklist, getUploadDuplicates)
+	m.Get("/uploads/:nzbid/related", limitRequests(LIMIT_SEARCH), checkBlacklist, getRelatedUploads)
+	m.Get("/poster/:name", limitRequests(LIMIT_SEARCH), getPosterProfile)
+	m.Get("/group/:name", limitRequests(LIMIT_SEARCH), getGroupPage)
+
+	m.Get("/api/v1/searches", requireApiKey, listSearches)
+	m.Post("/api/v1/searches", requireApiKey, createSearch)
+	m.Get("/api/v1/searches/:id", requireApiKey, getSearch)
+	m.Delete("/api/v1/searches/:id", requireApiKey, deleteSearch)
+	m.Get("/api/v1/searches/:id/deliveries", requireApiKey, getDeliveries)
+
+	m.Get("/api/v1/downloaders", requireApiKey, listDownloaders)
+	m.Post("/api/v1/downloaders", requireApiKey, createDownloader)
+	m.Delete("/api/v1/downloaders/:id", requireApiKey, deleteDownloader)
+
+	m.Get("/api/v1/blacklist", requireAdmin, listBlacklist)
+	m.Post("/api/v1/blacklist", requireAdmin, addBlacklistEntry)
+	m.Delete("/api/v1/blacklist/:id", requireAdmin, removeBlacklistEntry)
+	m.Get("/api/v1/blacklist/audit", requireAdmin, listAudit)
+
+	m.Get("/admin", adminConsole)
+	m.Get("/admin/api/status", requireAdmin, getAdminStatus)
+	m.Get("/admin/api/uploads", requireAdmin, listRecentUploads)
+	m.Post("/admin/api/uploads/:nzbid", requireAdmin, updateUpload)
+	m.Get("/admin/api/ingest", requireAdmin, getIngestRates)
+	m.Get("/admin/api/keys", requireAdmin, listKeyUsage)
+	m.Get("/admin/api/jobs", requireAdmin, listJobs)
+	m.Post("/admin/api/jobs/:name", requireAdmin, startJob)
 	m.Use(martini.Static("www"))
 
 }
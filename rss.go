@@ -3,10 +3,9 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
+	"html"
 	"net/http"
-	"net/url"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -24,18 +23,14 @@ type rss struct {
 }
 
 type RssChannel struct {
-	Title       string `xml:"title"`
-	Link        string `xml:"link"`
-	Description string `xml:"description"`
-	Language    string `xml:"language"`
-	AtomLink    struct {
-		Href string `xml:"href,attr"`
-		Rel  string `xml:"rel,attr"`
-		Type string `xml:"type,attr"`
-	} `xml:"atom:link"`
-	NewzNab struct {
-		Offset int `xml:"offset,attr"`
-		Total  int `xml:"total,attr"`
+	Title       string     `xml:"title"`
+	Link        string     `xml:"link"`
+	Description string     `xml:"description"`
+	Language    string     `xml:"language"`
+	AtomLinks   []AtomLink `xml:"atom:link"`
+	NewzNab     struct {
+		Offset int   `xml:"offset,attr"`
+		Total  int64 `xml:"total,attr"`
 	} `xml:"newznab:response"`
 	Items []RssItem `xml:"item"`
 }
@@ -43,6 +38,7 @@ type RssChannel struct {
 type RssItem struct {
 	Title       string `xml:"title"`
 	Link        string `xml:"link"`
+	Comments    string `xml:"comments,omitempty"`
 	Description string `xml:"description"`
 	Category    string `xml:"category"`
 	PubDate     string `xml:"pubDate"`
@@ -55,115 +51,107 @@ type RssItem struct {
 		Perma string `xml:"isPermalink,attr"`
 		Guid  string `xml:",innerxml"`
 	} `xml:"guid"`
+	Attrs []NewznabAttr `xml:"newznab:attr"`
+}
+
+type AtomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type NewznabAttr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
 }
 
 func genrss(ctx *context, res http.ResponseWriter, req *http.Request) {
-	req.ParseForm()
-	var searchQuery string
-	//var category string
-	var max int
-	if q, ok := req.Form["q"]; ok {
-		if q[0] == "" {
-			searchQuery = "*"
-		} else {
-			searchQuery = q[0]
-		}
-	} else {
-		switch req.URL.Path {
-		case "/rss":
-			searchQuery = "*"
-		}
+	switch req.FormValue("format") {
+	case "atom":
+		genatom(ctx, res, req)
+		return
+	case "json":
+		genjsonfeed(ctx, res, req)
+		return
 	}
-	/*
-		category = req.FormValue("cat")
-		categoryName := "All"
-		switch category {
-		case "anime":
-			categoryName = "Anime"
+	page := searchFeed(ctx, res, req)
+	if page == nil {
+		return
+	}
+	urls := page.Urls
+	feed := rss{
+		XmlnsAtom:    ATOM_XMLNS,
+		XmlnsNewzNab: NEWZNAB_XMLNS,
+		Version:      "2.0",
+		Channel: RssChannel{
+			Title:       page.Query + " &mdash; Animezb",
+			Link:        urls.Abs("/"),
+			Description: "Usenet Indexer for Japanese Media",
+			Language:    "en-us",
+		},
+	}
+	feed.Channel.AtomLinks = page.links("application/rss+xml")
+	feed.Channel.Items = make([]RssItem, len(page.Results))
+	feed.Channel.NewzNab.Offset = page.Offset
+	feed.Channel.NewzNab.Total = page.Total
+
+	for idx, res := range page.Results {
+		var postCat string
+		switch res.Group {
+		case "alt.binaries.anime", "alt.binaries.multimedia.anime", "alt.binaries.multimedia.anime.repost", "alt.binaries.multimedia.anime.highspeed":
+			postCat = "Anime"
 		default:
-			category = ""
+			postCat = "Anime"
 		}
-	*/
-	if n, err := strconv.Atoi(req.FormValue("max")); err == nil {
-		max = n
-	} else {
-		max = 50
-	}
-	if searchQuery == "" {
-		if f, err := ctx.HtmlDir.Open("/home.html"); err == nil {
-			defer f.Close()
-			if fi, err := f.Stat(); err != nil {
-				panic("Failed to stat index.html file.")
-			} else {
-				mod := fi.ModTime()
-				http.ServeContent(res, req, "/index.html", mod, f)
-			}
+		item := RssItem{
+			Title:       res.Name,
+			Link:        urls.Abs("/nzb/" + res.UploadId),
+			Comments:    urls.Abs("/upload/" + res.UploadId),
+			Description: formatRssDesc(res),
+			Category:    postCat,
+			PubDate:     res.Time.Format(time.RFC1123Z),
 		}
+		item.Enclosure.Url = nzbUrl(urls, res)
+		item.Enclosure.Length = res.Bytes
+		item.Enclosure.Type = "application/x-nzb"
+		item.Guid.Guid = urls.Abs("/nzb/" + res.UploadId)
+		item.Guid.Perma = "false"
+		item.Attrs = newznabAttrs(res)
+		feed.Channel.Items[idx] = item
+	}
+	if output, err := xml.Marshal(feed); err == nil {
+		res.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		res.WriteHeader(200)
+		res.Write([]byte(xml.Header))
+		res.Write(output)
 	} else {
-		res.Header().Set("Content-Type", "text/html")
-		sResults, _ := searchBackend(ctx, searchQuery, 0, max, true)
-		protocol := req.URL.Scheme + "://"
-		if protocol == "://" {
-			if useSSL := req.Header.Get("X-SSL"); useSSL == "true" {
-				protocol = "https://"
-			} else {
-				protocol = "http://"
-			}
-		}
-		hostname := req.Host
-		feed := rss{
-			XmlnsAtom:    ATOM_XMLNS,
-			XmlnsNewzNab: NEWZNAB_XMLNS,
-			Version:      "2.0",
-			Channel: RssChannel{
-				Title:       searchQuery + " &mdash; Animezb",
-				Link:        protocol + hostname,
-				Description: "Usenet Indexer for Japanese Media",
-				Language:    "en-us",
-			},
-		}
-		feed.Channel.AtomLink.Href = protocol + hostname + req.URL.String()
-		feed.Channel.AtomLink.Rel = "self"
-		feed.Channel.AtomLink.Type = "application/rss+xml"
-		feed.Channel.Items = make([]RssItem, len(sResults))
-		feed.Channel.NewzNab.Offset = 0
-		feed.Channel.NewzNab.Total = len(sResults)
+		panic(err)
+	}
+}
 
-		for idx, res := range sResults {
-			var postCat string
-			switch res.Group {
-			case "alt.binaries.anime", "alt.binaries.multimedia.anime", "alt.binaries.multimedia.anime.repost", "alt.binaries.multimedia.anime.highspeed":
-				postCat = "Anime"
-			default:
-				postCat = "Anime"
-			}
-			pDate, _ := time.Parse(time.UnixDate, res.Date)
-			item := RssItem{
-				Title:       res.Name,
-				Link:        protocol + hostname + "/nzb/" + res.UploadId,
-				Description: formatRssDesc(res),
-				Category:    postCat,
-				PubDate:     pDate.Format(time.RFC1123Z),
-			}
-			item.Enclosure.Url = protocol + hostname + "/nzb/" + res.UploadId + "/" + strings.Replace(url.QueryEscape(res.Name), "+", "%20", -1) + ".nzb"
-			item.Enclosure.Length = res.Bytes
-			item.Enclosure.Type = "application/x-nzb"
-			item.Guid.Guid = protocol + hostname + "/nzb/" + res.UploadId
-			item.Guid.Perma = "false"
-			feed.Channel.Items[idx] = item
-		}
-		if output, err := xml.Marshal(feed); err == nil {
-			res.Header().Set("Content-Type", "text/xml; charset=utf-8")
-			res.WriteHeader(200)
-			res.Write([]byte(xml.Header))
-			res.Write(output)
-		} else {
-			panic(err)
-		}
+func newznabAttrs(res searchResult) []NewznabAttr {
+	attrs := []NewznabAttr{
+		{Name: "size", Value: strconv.FormatInt(res.ContentBytes, 10)},
+		{Name: "recoverysize", Value: strconv.FormatInt(res.RecoveryBytes, 10)},
 	}
+	if res.AnimeId != 0 {
+		attrs = append(attrs,
+			NewznabAttr{Name: "anidbid", Value: strconv.Itoa(res.AnimeId)},
+			NewznabAttr{Name: "animetitle", Value: res.AnimeTitle})
+	}
+	return attrs
 }
 
 func formatRssDesc(sr searchResult) string {
-	format := `<i>Age</i>: %s<br /><i>Size</i>: %s<br /><i>Parts</i>: %s<br /><i>Files</i>: %s<br /><i>Subject</i>: %s`
-	return fmt.Sprintf(format, sr.Age, sr.Size, sr.Completion, sr.ExtTypes, sr.Subject)
+	format := `<i>Age</i>: %s<br /><i>Size</i>: %s<br /><i>Recovery</i>: %s<br /><i>Parts</i>: %s<br /><i>Files</i>: %s<br /><i>Subject</i>: %s`
+	subject := sr.SubjectHighlight
+	if subject == "" {
+		subject = html.EscapeString(sr.Subject)
+	}
+	desc := fmt.Sprintf(format, sr.Age, sr.ContentSize, sr.RecoverySize, sr.Completion, sr.ExtTypes, subject)
+	if sr.Availability != "" {
+		desc += `<br /><i>Available</i>: ` + sr.Availability
+	}
+	return desc
 }
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookAttempts = 5
+	webhookTimeout  = 30 * time.Second
+	// Matches delivered per webhook call.
+	watchBatchSize = 100
+	// Webhook calls per saved search and pass, the rest of the matches
+	// wait for the next pass.
+	watchMaxBatches = 10
+	// Uploads are looked for this long before the last one delivered, as
+	// they can be indexed well after they were posted.
+	watchLookback = 24 * time.Hour
+)
+
+// Delay before the first webhook retry, doubled on every further attempt.
+var webhookBackoff = 2 * time.Second
+
+var (
+	webhookClient = newOutboundClient(webhookTimeout, false)
+	// For searches saved by admins, which may notify internal hosts.
+	adminWebhookClient = newOutboundClient(webhookTimeout, true)
+)
+
+type savedSearch struct {
+	Id           string `json:"id"`
+	ApiKey       string `json:"apikey"`
+	Name         string `json:"name"`
+	Query        string `json:"query"`
+	OnlyComplete bool   `json:"onlycomplete"`
+	MinSize      int64  `json:"minsize"`
+	MaxSize      int64  `json:"maxsize"`
+	Webhook      string `json:"webhook"`
+	// Date of the newest upload delivered.
+	LastSeen time.Time `json:"lastseen"`
+	// Uploads delivered within watchLookback of LastSeen.
+	Delivered []deliveredUpload `json:"delivered"`
+	Created   time.Time         `json:"created"`
+	// Why Query can't be run any more, if it can't.
+	QueryError string `json:"queryerror,omitempty"`
+}
+
+type deliveredUpload struct {
+	Id   string    `json:"id"`
+	Date time.Time `json:"date"`
+}
+
+type webhookDelivery struct {
+	SearchId string    `json:"search"`
+	ApiKey   string    `json:"apikey"`
+	Url      string    `json:"url"`
+	Matches  int       `json:"matches"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Date     time.Time `json:"date"`
+}
+
+type webhookMatch struct {
+	UploadId   string   `json:"uploadid"`
+	Name       string   `json:"name"`
+	Subject    string   `json:"subject"`
+	Poster     string   `json:"poster"`
+	Groups     []string `json:"groups"`
+	Bytes      int64    `json:"bytes"`
+	Size       string   `json:"size"`
+	Completion string   `json:"completion"`
+	Date       string   `json:"date"`
+	AnimeId    int      `json:"anidbid,omitempty"`
+	AnimeTitle string   `json:"animetitle,omitempty"`
+	Nzb        string   `json:"nzb"`
+}
+
+type webhookPayload struct {
+	Search struct {
+		Id    string `json:"id"`
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"search"`
+	Matches []webhookMatch `json:"matches"`
+}
+
+// options returns the search for the uploads not yet delivered, oldest
+// first, starting at the cursor from of the previous batch if it isn't nil.
+func (s *savedSearch) options(from *searchCursor) searchOptions {
+	c := &searchCursor{Newer: true, Date: s.since()}
+	if from != nil {
+		c.Date = from.Date
+		c.Seen = append(c.Seen, from.Seen...)
+	}
+	for _, d := range s.Delivered {
+		if !d.Date.Before(c.Date) {
+			c.Seen = append(c.Seen, d.Id)
+		}
+	}
+	return searchOptions{
+		Query:        s.Query,
+		Length:       watchBatchSize,
+		OnlyComplete: s.OnlyComplete,
+		MinSize:      s.MinSize,
+		MaxSize:      s.MaxSize,
+		Cursor:       c,
+	}
+}
+
+// since is the date uploads are looked for from. Uploads posted before the
+// search was saved are never delivered.
+func (s *savedSearch) since() time.Time {
+	if s.Delivered == nil {
+		// Saved before deliveries were remembered, everything up to
+		// LastSeen was delivered.
+		return s.LastSeen.Add(time.Millisecond)
+	}
+	since := s.LastSeen.Add(-watchLookback)
+	if len(s.Delivered) >= maxCursorSeen && s.Delivered[0].Date.After(since) {
+		// Too many deliveries to remember them all.
+		since = s.Delivered[0].Date
+	}
+	if s.Created.After(since) {
+		since = s.Created
+	}
+	return since
+}
+
+// delivered records that results were delivered.
+func (s *savedSearch) delivered(results []searchResult) {
+	for _, r := range results {
+		s.Delivered = append(s.Delivered, deliveredUpload{Id: r.UploadId, Date: r.Time})
+		if r.Time.After(s.LastSeen) {
+			s.LastSeen = r.Time
+		}
+	}
+	sort.Sort(deliveredUploads(s.Delivered))
+	keep := s.Delivered[:0]
+	for _, d := range s.Delivered {
+		if !d.Date.Before(s.LastSeen.Add(-watchLookback)) {
+			keep = append(keep, d)
+		}
+	}
+	if len(keep) > maxCursorSeen {
+		keep = keep[len(keep)-maxCursorSeen:]
+	}
+	s.Delivered = keep
+}
+
+// deliveredUploads sorts deliveries oldest first.
+type deliveredUploads []deliveredUpload
+
+func (d deliveredUploads) Len() int           { return len(d) }
+func (d deliveredUploads) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d deliveredUploads) Less(i, j int) bool { return d[i].Date.Before(d[j].Date) }
+
+func getSavedSearch(ctx *context, id string) (*savedSearch, error) {
+	var esResp struct {
+		Source savedSearch `json:"_source"`
+	}
+	if err := esRequest(ctx, "GET", dataPath(ctx, "savedsearch")+"/"+id, nil, &esResp); err != nil {
+		return nil, err
+	}
+	esResp.Source.Id = id
+	return &esResp.Source, nil
+}
+
+// listSavedSearches returns the saved searches of apikey, or every saved
+// search if apikey is empty.
+func listSavedSearches(ctx *context, apikey string) ([]savedSearch, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"size": 10000,
+	}
+	if apikey != "" {
+		query["query"] = map[string]interface{}{
+			"match": map[string]interface{}{
+				"apikey": map[string]interface{}{
+					"query":    apikey,
+					"operator": "and",
+				},
+			},
+		}
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", dataPath(ctx, "savedsearch")+"/_search", query, &esResp); err != nil {
+		if isNotFound(err) {
+			return []savedSearch{}, nil
+		}
+		return nil, err
+	}
+	searches := make([]savedSearch, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		var s savedSearch
+		if err := json.Unmarshal(hit.Source, &s); err != nil {
+			return nil, err
+		}
+		// The match query is analyzed, make sure the key really is the same.
+		if apikey != "" && s.ApiKey != apikey {
+			continue
+		}
+		s.Id = hit.Id
+		searches = append(searches, s)
+	}
+	return searches, nil
+}
+
+func listSearches(ctx *context, user *apiUser, res http.ResponseWriter) {
+	searches, err := listSavedSearches(ctx, user.Key)
+	if err != nil {
+		panic(err)
+	}
+	writeJson(res, 200, searches)
+}
+
+func createSearch(ctx *context, user *apiUser, res http.ResponseWriter, req *http.Request) {
+	var s savedSearch
+	if req.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			jsonError(res, 400, "invalid json: "+err.Error())
+			return
+		}
+	} else {
+		req.ParseForm()
+		s.Name = req.FormValue("name")
+		s.Query = req.FormValue("q")
+		s.Webhook = req.FormValue("webhook")
+		_, nocomp := req.Form["nocomp"]
+		s.OnlyComplete = !nocomp
+		s.MinSize, _ = strconv.ParseInt(req.FormValue("minsize"), 10, 64)
+		s.MaxSize, _ = strconv.ParseInt(req.FormValue("maxsize"), 10, 64)
+	}
+	if s.Query == "" {
+		jsonError(res, 400, "missing query")
+		return
+	}
+	if _, err := parseQuery(s.Query); err != nil {
+		jsonError(res, 400, err.Error())
+		return
+	}
+	if err := checkOutboundUrl(s.Webhook, user); err != nil {
+		jsonError(res, 400, "webhook "+err.Error())
+		return
+	}
+	if s.Name == "" {
+		s.Name = s.Query
+	}
+	s.ApiKey = user.Key
+	s.Created = time.Now().UTC()
+	// Only notify about uploads made after the search was saved.
+	s.LastSeen = s.Created
+	s.Delivered = []deliveredUpload{}
+	s.QueryError = ""
+	var esResp struct {
+		Id string `json:"_id"`
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "savedsearch")+"?refresh=true", s, &esResp); err != nil {
+		panic(err)
+	}
+	s.Id = esResp.Id
+	writeJson(res, 201, s)
+}
+
+func ownedSearch(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter) *savedSearch {
+	s, err := getSavedSearch(ctx, params["id"])
+	if err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such search")
+			return nil
+		}
+		panic(err)
+	}
+	if s.ApiKey != user.Key {
+		jsonError(res, 404, "no such search")
+		return nil
+	}
+	return s
+}
+
+func getSearch(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter) {
+	if s := ownedSearch(ctx, user, params, res); s != nil {
+		writeJson(res, 200, s)
+	}
+}
+
+func deleteSearch(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter) {
+	if s := ownedSearch(ctx, user, params, res); s != nil {
+		if err := esRequest(ctx, "DELETE", dataPath(ctx, "savedsearch")+"/"+s.Id+"?refresh=true", nil, nil); err != nil {
+			panic(err)
+		}
+		res.WriteHeader(204)
+	}
+}
+
+func getDeliveries(ctx *context, user *apiUser, params martini.Params, res http.ResponseWriter) {
+	s := ownedSearch(ctx, user, params, res)
+	if s == nil {
+		return
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match": map[string]interface{}{
+				"search": s.Id,
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size": 100,
+	}
+	var esResp esSourceResp
+	deliveries := make([]webhookDelivery, 0, 100)
+	if err := esRequest(ctx, "POST", dataPath(ctx, "delivery")+"/_search", query, &esResp); err != nil && !isNotFound(err) {
+		panic(err)
+	}
+	for _, hit := range esResp.Hits.Hits {
+		var d webhookDelivery
+		if json.Unmarshal(hit.Source, &d) == nil && d.SearchId == s.Id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	writeJson(res, 200, deliveries)
+}
+
+// watchSavedSearches runs every saved search once per interval, forever.
+func watchSavedSearches(ctx *context, interval time.Duration) {
+	for {
+		searches, err := listSavedSearches(ctx, "")
+		if err != nil {
+			log.Printf("Failed to list saved searches: %s", err)
+		}
+		for i := range searches {
+			runSavedSearch(ctx, &searches[i])
+		}
+		time.Sleep(interval)
+	}
+}
+
+// runSavedSearch delivers the uploads matching a saved search that weren't
+// delivered yet, oldest first, in batches of watchBatchSize.
+func runSavedSearch(ctx *context, s *savedSearch) {
+	defer func() {
+		// searchBackend panics on failure, don't take the watcher down with it.
+		if r := recover(); r != nil {
+			log.Printf("Saved search %s failed: %v", s.Id, r)
+		}
+	}()
+	if !checkSavedQuery(ctx, s) {
+		return
+	}
+	client := webhookClient
+	if user := ctx.Keys.get(s.ApiKey); user != nil && user.Admin {
+		client = adminWebhookClient
+	}
+	var cursor *searchCursor
+	for batch := 0; batch < watchMaxBatches; batch++ {
+		page, err := searchBackend(ctx, s.options(cursor))
+		if err != nil {
+			log.Printf("Saved search %s failed: %s", s.Id, err)
+			return
+		}
+		if len(page.Results) > 0 && !runWebhook(ctx, client, s, page.Results) {
+			// Undelivered matches are picked up again on the next pass.
+			return
+		}
+		if page.Newer == nil {
+			return
+		}
+		cursor = page.Newer
+	}
+}
+
+// checkSavedQuery reports whether the query of a saved search can be run,
+// migrating queries saved in the old syntax. Queries that can't be run are
+// reported once, as a failed delivery.
+func checkSavedQuery(ctx *context, s *savedSearch) bool {
+	_, err := parseQuery(s.Query)
+	if err == nil {
+		return true
+	}
+	if q := migrateQuery(s.Query); q != s.Query {
+		if _, qerr := parseQuery(q); qerr == nil {
+			log.Printf("Migrated the query of saved search %s from %q to %q", s.Id, s.Query, q)
+			s.Query = q
+			s.QueryError = ""
+			update := map[string]interface{}{
+				"doc": map[string]interface{}{
+					"query":      s.Query,
+					"queryerror": "",
+				},
+			}
+			if err := esRequest(ctx, "POST", dataPath(ctx, "savedsearch")+"/"+s.Id+"/_update", update, nil); err != nil {
+				log.Printf("Failed to update saved search %s: %s", s.Id, err)
+			}
+			return true
+		}
+	}
+	if s.QueryError == err.Error() {
+		return false
+	}
+	s.QueryError = err.Error()
+	delivery := webhookDelivery{
+		SearchId: s.Id,
+		ApiKey:   s.ApiKey,
+		Url:      s.Webhook,
+		Error:    "invalid query: " + s.QueryError,
+		Date:     time.Now().UTC(),
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "delivery"), delivery, nil); err != nil {
+		log.Printf("Failed to log webhook delivery for %s: %s", s.Id, err)
+	}
+	update := map[string]interface{}{
+		"doc": map[string]interface{}{
+			"queryerror": s.QueryError,
+		},
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "savedsearch")+"/"+s.Id+"/_update", update, nil); err != nil {
+		log.Printf("Failed to update saved search %s: %s", s.Id, err)
+	}
+	return false
+}
+
+// runWebhook delivers a batch of results of a saved search, and records
+// them as delivered if the webhook accepted them.
+func runWebhook(ctx *context, client *http.Client, s *savedSearch, results []searchResult) bool {
+	payload := webhookPayload{Matches: make([]webhookMatch, 0, len(results))}
+	payload.Search.Id = s.Id
+	payload.Search.Name = s.Name
+	payload.Search.Query = s.Query
+	// Results are newest first, matches are sent oldest first.
+	for i := len(results) - 1; i >= 0; i-- {
+		r := results[i]
+		payload.Matches = append(payload.Matches, webhookMatch{
+			UploadId:   r.UploadId,
+			Name:       r.Name,
+			Subject:    r.Subject,
+			Poster:     r.Poster,
+			Groups:     r.Groups,
+			Bytes:      r.Bytes,
+			Size:       r.Size,
+			Completion: r.Completion,
+			Date:       r.Time.Format(time.RFC3339),
+			AnimeId:    r.AnimeId,
+			AnimeTitle: r.AnimeTitle,
+			Nzb:        ctx.Urls.Abs("/nzb/" + r.UploadId + "/" + urlPath(r.Name) + ".nzb"),
+		})
+	}
+	delivery := deliverWebhook(client, s.Webhook, payload)
+	delivery.SearchId = s.Id
+	delivery.ApiKey = s.ApiKey
+	if err := esRequest(ctx, "POST", dataPath(ctx, "delivery"), delivery, nil); err != nil {
+		log.Printf("Failed to log webhook delivery for %s: %s", s.Id, err)
+	}
+	if delivery.Error != "" {
+		return false
+	}
+	s.delivered(results)
+	update := map[string]interface{}{
+		"doc": map[string]interface{}{
+			"lastseen":  s.LastSeen,
+			"delivered": s.Delivered,
+		},
+	}
+	if err := esRequest(ctx, "POST", dataPath(ctx, "savedsearch")+"/"+s.Id+"/_update", update, nil); err != nil {
+		log.Printf("Failed to update saved search %s: %s", s.Id, err)
+		return false
+	}
+	return true
+}
+
+// deliverWebhook POSTs payload to url, retrying with exponential backoff
+// until it is accepted with a 2xx status or webhookAttempts runs out.
+func deliverWebhook(client *http.Client, hook string, payload webhookPayload) webhookDelivery {
+	d := webhookDelivery{
+		Url:     hook,
+		Matches: len(payload.Matches),
+		Date:    time.Now().UTC(),
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+	backoff := webhookBackoff
+	for d.Attempts = 1; ; d.Attempts++ {
+		d.Status, err = postWebhook(client, hook, b)
+		if err == nil {
+			d.Error = ""
+			return d
+		}
+		d.Error = err.Error()
+		if d.Attempts >= webhookAttempts {
+			return d
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(client *http.Client, hook string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "animezb")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
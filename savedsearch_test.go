@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStandIn is a webhook receiver failing its first calls.
+type webhookStandIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	fails    int
+	calls    int
+	payloads []webhookPayload
+}
+
+func newWebhookStandIn(fails int) *webhookStandIn {
+	h := &webhookStandIn{fails: fails}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.calls++
+		if h.calls <= h.fails {
+			w.WriteHeader(503)
+			return
+		}
+		var p webhookPayload
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&p) != nil {
+			w.WriteHeader(400)
+			return
+		}
+		h.payloads = append(h.payloads, p)
+		w.WriteHeader(204)
+	}))
+	return h
+}
+
+func testPayload() webhookPayload {
+	var p webhookPayload
+	p.Search.Id = "search"
+	p.Matches = []webhookMatch{{UploadId: "upload", Nzb: "http://animezb.example/nzb/upload"}}
+	return p
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	defer func(b time.Duration) { webhookBackoff = b }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	h := newWebhookStandIn(2)
+	defer h.Close()
+
+	d := deliverWebhook(adminWebhookClient, h.URL, testPayload())
+	if d.Error != "" || d.Status != 204 || d.Attempts != 3 || d.Matches != 1 {
+		t.Fatalf("delivery = %+v, want accepted on the third attempt", d)
+	}
+	if len(h.payloads) != 1 || h.payloads[0].Search.Id != "search" || h.payloads[0].Matches[0].UploadId != "upload" {
+		t.Errorf("received %+v", h.payloads)
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	defer func(b time.Duration) { webhookBackoff = b }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	h := newWebhookStandIn(webhookAttempts)
+	defer h.Close()
+
+	d := deliverWebhook(adminWebhookClient, h.URL, testPayload())
+	if d.Error == "" || d.Status != 503 || d.Attempts != webhookAttempts {
+		t.Errorf("delivery = %+v, want a failure after %d attempts", d, webhookAttempts)
+	}
+}
+
+func TestWebhookInternalHosts(t *testing.T) {
+	defer func(b time.Duration) { webhookBackoff = b }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	h := newWebhookStandIn(0)
+	defer h.Close()
+
+	if d := deliverWebhook(webhookClient, h.URL, testPayload()); d.Error == "" {
+		t.Errorf("delivery to %s succeeded: %+v", h.URL, d)
+	}
+	if h.calls != 0 {
+		t.Errorf("webhook called %d times", h.calls)
+	}
+	for _, hook := range []string{h.URL, "http://localhost:9200/", "http://10.1.2.3/", "http://169.254.169.254/", "http://[::1]:80/", "ftp://example.com/"} {
+		if err := checkOutboundUrl(hook, &apiUser{}); err == nil {
+			t.Errorf("webhook %s allowed", hook)
+		}
+	}
+	if err := checkOutboundUrl(h.URL, &apiUser{Admin: true}); err != nil {
+		t.Errorf("webhook of an admin refused: %s", err)
+	}
+}
+
+func TestSavedSearchDelivered(t *testing.T) {
+	created := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := savedSearch{Created: created, LastSeen: created, Delivered: []deliveredUpload{}}
+	if c := s.options(nil).Cursor; !c.Newer || !c.Date.Equal(created) || len(c.Seen) != 0 {
+		t.Fatalf("cursor of a new search = %+v", c)
+	}
+
+	results := make([]searchResult, 0, 3)
+	for i := 3; i > 0; i-- {
+		results = append(results, searchResult{UploadId: strconv.Itoa(i), Time: created.Add(time.Duration(i) * time.Hour)})
+	}
+	s.delivered(results)
+	if !s.LastSeen.Equal(created.Add(3 * time.Hour)) {
+		t.Errorf("last seen = %s", s.LastSeen)
+	}
+	// Uploads indexed late are still looked for, but not the delivered ones.
+	c := s.options(nil).Cursor
+	if !c.Date.Equal(created) || len(c.Seen) != 3 {
+		t.Errorf("cursor = %+v, want to start at %s without the 3 delivered uploads", c, created)
+	}
+
+	s.delivered([]searchResult{{UploadId: "4", Time: created.Add(48 * time.Hour)}})
+	if len(s.Delivered) != 1 || s.Delivered[0].Id != "4" {
+		t.Errorf("delivered = %+v, want only the uploads within the lookback", s.Delivered)
+	}
+	if c := s.options(nil).Cursor; !c.Date.Equal(created.Add(24*time.Hour)) || len(c.Seen) != 1 {
+		t.Errorf("cursor = %+v", c)
+	}
+
+	// Searches saved before deliveries were remembered carry on after
+	// the last upload delivered.
+	old := savedSearch{Created: created, LastSeen: created.Add(time.Hour)}
+	if c := old.options(nil).Cursor; !c.Date.After(old.LastSeen) {
+		t.Errorf("cursor = %+v", c)
+	}
+}
+
+func TestMigrateQuery(t *testing.T) {
+	for q, want := range map[string]string{
+		"+horriblesubs +1080p":       "horriblesubs 1080p",
+		"one piece && NOT raw":       "one piece -raw",
+		"!raw poster:\"foo bar\"":    "-raw poster:\"foo bar\"",
+		"shingeki OR kyojin":         "shingeki OR kyojin",
+		"horriblesubs -480p ext:mkv": "horriblesubs -480p ext:mkv",
+	} {
+		if got := migrateQuery(q); got != want {
+			t.Errorf("migrateQuery(%q) = %q, want %q", q, got, want)
+		}
+	}
+	if _, err := parseQuery(migrateQuery("+one +piece NOT raw")); err != nil {
+		t.Errorf("migrated query doesn't parse: %s", err)
+	}
+}
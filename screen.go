@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// Uploads screened per pass of the screening watcher.
+const screenBatchSize = 500
+
+// posterHash identifies a poster exactly. poster is analyzed, so the hash
+// is stored next to it to match the uploads of a poster and nobody else,
+// as a number as a string would be analyzed as well.
+func posterHash(poster string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(poster))
+	return int64(h.Sum64())
+}
+
+// posterFilter matches the uploads of exactly poster.
+func posterFilter(poster string) map[string]interface{} {
+	return map[string]interface{}{
+		"term": map[string]interface{}{
+			"posterhash": posterHash(poster),
+		},
+	}
+}
+
+// unscreenedUploads returns the newest uploads that weren't screened yet,
+// or were screened against other poster and subject entries.
+func unscreenedUploads(ctx *context) (map[string]uploadDoc, error) {
+	version := ctx.Blacklist.patternVersion()
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"filter": map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"screened": version,
+				},
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size":    screenBatchSize,
+		"_source": []string{"poster", "subject", "blacklisted"},
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		return nil, err
+	}
+	uploads := make(map[string]uploadDoc, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		var u uploadDoc
+		if err := json.Unmarshal(hit.Source, &u); err != nil {
+			return nil, err
+		}
+		uploads[hit.Id] = u
+	}
+	return uploads, nil
+}
+
+// screenUpload stores what searches need to know about an upload but can't
+// get from its analyzed fields: the hash of its poster, and whether a
+// poster or subject entry blacklists it.
+func screenUpload(ctx *context, uploadId string, u uploadDoc) error {
+	blacklisted, version := ctx.Blacklist.screen(u.Poster, u.Subject)
+	update := map[string]interface{}{
+		"doc": map[string]interface{}{
+			"posterhash":  posterHash(u.Poster),
+			"blacklisted": blacklisted,
+			"screened":    version,
+		},
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/"+uploadId+"/_update", update, nil); err != nil {
+		return err
+	}
+	if blacklisted != u.Blacklisted {
+		repickAlternatives(ctx, uploadId)
+	}
+	return nil
+}
+
+// watchScreening screens new uploads as they are indexed, and every upload
+// again when poster or subject entries are added or removed.
+func watchScreening(ctx *context, interval time.Duration) {
+	for {
+		uploads, err := unscreenedUploads(ctx)
+		if err != nil {
+			log.Printf("Failed to find uploads to screen: %s", err)
+		}
+		failed := false
+		for id, u := range uploads {
+			if err := screenUpload(ctx, id, u); err != nil {
+				log.Printf("Screening %s failed: %s", id, err)
+				failed = true
+			}
+		}
+		if failed || len(uploads) < screenBatchSize {
+			time.Sleep(interval)
+		}
+	}
+}
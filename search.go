@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -11,10 +12,30 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
+const (
+	// Marks around highlighted words, from the private use area so they
+	// can't be mistaken for anything in a subject.
+	highlightStart = "\ue000"
+	highlightEnd   = "\ue001"
+	// Highlighted parts of a subject, and their length.
+	subjectFragments    = 3
+	subjectFragmentSize = 120
+)
+
+const (
+	// Extra results fetched for every page while the blacklist has poster
+	// or subject entries, to make up for the results not screened against
+	// them yet and left out.
+	blacklistPadding = 20
+	// Results on a page of the search page.
+	searchPageLength = 200
+	// Pages of the search page linked to by number.
+	numberedPages = maxSearchOffset / searchPageLength
+)
+
 type searchHits struct {
 	Total int64             `json:"total"`
 	Hits  []json.RawMessage `json:"hits"`
@@ -35,11 +56,18 @@ type searchField struct {
 	Date       []string  `json:"date"`
 	Group      []string  `json:"group"`
 	Completion []float64 `json:"completion"`
+	// Set once the upload has been checked against the NNTP server.
+	Availability []float64 `json:"availability"`
+	Fingerprint  []string  `json:"fingerprint"`
+	// Set by admins.
+	Hidden   []bool   `json:"hidden"`
+	Category []string `json:"category"`
 }
 
 type searchHit struct {
-	Id     string      `json:"_id"`
-	Fields searchField `json:"fields"`
+	Id        string              `json:"_id"`
+	Fields    searchField         `json:"fields"`
+	Highlight map[string][]string `json:"highlight"`
 }
 
 type searchResult struct {
@@ -48,31 +76,92 @@ type searchResult struct {
 	UploadId        string
 	Size            string
 	Bytes           int64
+	ContentSize     string
+	ContentBytes    int64
+	RecoverySize    string
+	RecoveryBytes   int64
 	CompletedParts  string
 	TotalParts      string
 	Completion      string
 	CompletionClass string
+	Availability    string
 	Category        string
 	Age             string
 	Types           []string
 	ExtTypes        string
 	Date            string
+	Time            time.Time
 	FullGroup       string
+	Groups          []string
 	Group           string
 	Poster          string
+	AnimeId         int
+	AnimeTitle      string
+	Fingerprint     string
+	Alternatives    int
+	Hidden          bool
+	// Name and the parts of Subject the query matched, as HTML with the
+	// words matched in <mark>. Empty when nothing in them matched.
+	NameHighlight    string
+	SubjectHighlight string
 }
 
 type searchResults struct {
 	Query        string
+	Collapse     bool
 	Category     string
 	CategoryName string
 	Results      []searchResult
 	Pagination   []searchPages
-	Page         string
-	PrevPage     string
-	NextPage     string
-	LastPage     string
-	UrlPath      func(string) string
+	// Page is "" on pages reached with a cursor.
+	Page     string
+	LastPage string
+	// Links to the neighbouring pages, "" at either end.
+	PrevLink string
+	NextLink string
+	Base     string
+	UrlPath  func(string) string
+	// PageLink returns the link to a numbered page of the same search.
+	PageLink func(string) string
+	// What is wrong with Query, if it couldn't be run.
+	Error string
+}
+
+type searchOptions struct {
+	Query string
+	// Results skipped are Offset + Page*Length.
+	Offset       int
+	Page         int
+	Length       int
+	OnlyComplete bool
+	// Uploads that haven't been checked against the NNTP server yet are
+	// never filtered out by MinAvailability.
+	MinAvailability float64
+	MinSize         int64
+	MaxSize         int64
+	After           time.Time
+	// Show duplicates of an upload as a single result, leaving out the
+	// uploads marked as alternatives.
+	Collapse bool
+	// Include uploads hidden by an admin.
+	ShowHidden bool
+	// Mark the words matched in names and subjects.
+	Highlight bool
+	// Start after a cursor instead of at an offset.
+	Cursor *searchCursor
+	// Only search the uploads of exactly this poster, if not empty.
+	Poster string
+}
+
+// resultPage is a page of search results.
+type resultPage struct {
+	Results []searchResult
+	// Results of the whole search.
+	Total int64
+	// Cursors of the pages of older and newer results, nil when there are
+	// none.
+	Older *searchCursor
+	Newer *searchCursor
 }
 
 type searchPages struct {
@@ -102,6 +191,8 @@ func search(ctx *context, res http.ResponseWriter, req *http.Request) {
 		}
 	}
 	_, nocomp := req.Form["nocomp"]
+	collapse := req.FormValue("collapse") != "0"
+	minAvail := parseMinAvailability(req)
 	category = req.FormValue("cat")
 	categoryName := "All"
 	switch category {
@@ -110,13 +201,17 @@ func search(ctx *context, res http.ResponseWriter, req *http.Request) {
 	default:
 		category = ""
 	}
-	if n, err := strconv.Atoi(req.FormValue("p")); err == nil {
+	if n, err := strconv.Atoi(req.FormValue("p")); err == nil && n > 1 {
 		page = n - 1
-		if n < 0 {
-			n = 0
-		}
-	} else {
-		page = 0
+	}
+	// Deeper pages are reached with cursors.
+	if page >= numberedPages {
+		page = numberedPages - 1
+	}
+	var cursor *searchCursor
+	var cursorErr error
+	if token := req.FormValue("cursor"); token != "" {
+		cursor, cursorErr = parseCursor(token)
 	}
 	if searchQuery == "" {
 		if f, err := ctx.HtmlDir.Open("/home.html"); err == nil {
@@ -130,33 +225,109 @@ func search(ctx *context, res http.ResponseWriter, req *http.Request) {
 		}
 	} else {
 		res.Header().Set("Content-Type", "text/html")
-		sResults, total := searchBackend(ctx, searchQuery, page, 200, !nocomp)
-		lastpage := total/200 + 1
+		var found resultPage
+		err := cursorErr
+		if err == nil {
+			found, err = searchBackend(ctx, searchOptions{
+				Query:        searchQuery,
+				Page:         page,
+				Length:       searchPageLength,
+				OnlyComplete: !nocomp,
+
+				MinAvailability: minAvail,
+				Collapse:        collapse,
+				Highlight:       true,
+				Cursor:          cursor,
+			})
+		}
+		lastpage := int(found.Total/searchPageLength) + 1
+		if lastpage > numberedPages {
+			lastpage = numberedPages
+		}
 		results := searchResults{
 			Query:        searchQuery,
+			Collapse:     collapse,
 			Category:     category,
 			CategoryName: categoryName,
-			Results:      sResults,
-			Pagination:   pagination(page, int(lastpage)),
+			Results:      found.Results,
+			Pagination:   pagination(page, lastpage),
 			Page:         strconv.Itoa(page + 1),
-			PrevPage:     strconv.Itoa(page),
-			NextPage:     strconv.Itoa(page + 2),
-			LastPage:     strconv.Itoa(int(lastpage)),
+			LastPage:     strconv.Itoa(lastpage),
+			Base:         ctx.urls(req).Prefix,
 			UrlPath:      urlPath,
 		}
-		t, err := template.New("results.html").ParseFiles("./www/results.html")
-		if err == nil {
-			res.WriteHeader(200)
-			if err := t.Execute(res, results); err != nil {
-				panic(err)
+		link := func(p int, c *searchCursor) string {
+			v := url.Values{"q": {searchQuery}, "cat": {category}}
+			if !collapse {
+				v.Set("collapse", "0")
 			}
-		} else {
-			panic(err)
+			if nocomp {
+				v.Set("nocomp", "1")
+			}
+			if m := req.FormValue("minavail"); m != "" {
+				v.Set("minavail", m)
+			}
+			if c != nil {
+				v.Set("cursor", c.String())
+			} else {
+				v.Set("p", strconv.Itoa(p))
+			}
+			return results.Base + "/?" + v.Encode()
+		}
+		results.PageLink = func(p string) string {
+			n, _ := strconv.Atoi(p)
+			return link(n, nil)
+		}
+		if cursor != nil {
+			results.Page = ""
+			results.Pagination = pagination(0, lastpage)
+			if found.Newer != nil {
+				results.PrevLink = link(0, found.Newer)
+			}
+		} else if page > 0 {
+			results.PrevLink = link(page, nil)
+		}
+		if cursor == nil && page+1 < lastpage {
+			results.NextLink = link(page+2, nil)
+		} else if found.Older != nil {
+			results.NextLink = link(0, found.Older)
 		}
+		if err != nil {
+			results.Error = err.Error()
+			results.Pagination = nil
+		}
+		renderTemplate(res, "results.html", results)
 		return
 	}
 }
 
+// parseMinAvailability reads the minimum availability, in percent, from
+// the minavail parameter, falling back to the -minavail flag.
+func parseMinAvailability(req *http.Request) float64 {
+	if n, err := strconv.ParseFloat(req.FormValue("minavail"), 64); err == nil && n >= 0 && n <= 100 {
+		return n / 100
+	}
+	return minAvailability / 100
+}
+
+// highlightHTML escapes a highlighted fragment and marks the words
+// highlighted in it.
+func highlightHTML(fragment string) string {
+	s := html.EscapeString(fragment)
+	s = strings.Replace(s, highlightStart, "<mark>", -1)
+	return strings.Replace(s, highlightEnd, "</mark>", -1)
+}
+
+func formatAge(t time.Time) string {
+	d := time.Now().Sub(t)
+	if d.Minutes() < 90 {
+		return fmt.Sprintf("%0.0fm", d.Minutes())
+	} else if d.Hours() < 12 {
+		return fmt.Sprintf("%0.0fh", d.Hours())
+	}
+	return fmt.Sprintf("%0.0fd", d.Hours()/24)
+}
+
 func pagination(page int, totalPages int) []searchPages {
 	startPage := page - 4
 	if page < 5 {
@@ -186,30 +357,162 @@ func pagination(page int, totalPages int) []searchPages {
 	return sp
 }
 
-func searchBackend(ctx *context, searchQuery string, page int, length int, onlycomplete bool) ([]searchResult, int64) {
+// countResults counts the uploads matching a query and filters.
+func countResults(ctx *context, esQuery map[string]interface{}, filters []interface{}) int64 {
+	filter := map[string]interface{}{
+		"match_all": map[string]interface{}{},
+	}
+	if len(filters) > 0 {
+		filter = map[string]interface{}{
+			"and": filters,
+		}
+	}
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
-			"query_string": map[string]interface{}{
-				"query":            searchQuery,
-				"default_operator": "AND",
+			"filtered": map[string]interface{}{
+				"query":  esQuery,
+				"filter": filter,
 			},
 		},
-		"from": page * length,
-		"size": length,
+	}
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_count", query, &count); err != nil {
+		panic(err)
+	}
+	return count.Count
+}
+
+// searchBackend runs a search. The only errors returned are about the
+// query or the page asked for, anything else panics.
+func searchBackend(ctx *context, opts searchOptions) (resultPage, error) {
+	parsed, err := parseQuery(opts.Query)
+	if err != nil {
+		return resultPage{}, err
+	}
+	from := opts.Offset + opts.Page*opts.Length
+	order := "desc"
+	if opts.Cursor != nil {
+		from = 0
+		if opts.Cursor.Newer {
+			order = "asc"
+		}
+	} else if from > maxSearchOffset {
+		return resultPage{}, fmt.Errorf("results past the first %d can only be paged to with a cursor", maxSearchOffset)
+	}
+	esQuery, filters := parsed.compile(ctx.Titles)
+	size := opts.Length
+	if ctx.Blacklist.hasPatterns() {
+		size += blacklistPadding
+	}
+	query := map[string]interface{}{
+		"query": esQuery,
+		"from":  from,
+		"size":  size,
 		"sort": []map[string]string{
 			map[string]string{
-				"date": "desc",
+				"date": order,
 			},
 		},
 		"fields": "*",
 	}
-	if onlycomplete {
-		query["filter"] = map[string]interface{}{
+	if opts.Highlight {
+		query["highlight"] = map[string]interface{}{
+			"pre_tags":  []string{highlightStart},
+			"post_tags": []string{highlightEnd},
+			"fields": map[string]interface{}{
+				"filename": map[string]interface{}{
+					"number_of_fragments": 0,
+				},
+				"subject": map[string]interface{}{
+					"fragment_size":       subjectFragmentSize,
+					"number_of_fragments": subjectFragments,
+				},
+			},
+		}
+	}
+	if opts.OnlyComplete {
+		filters = append(filters, map[string]interface{}{
 			"range": map[string]interface{}{
 				"completion": map[string]interface{}{
 					"gte": .9,
 				},
 			},
+		})
+	}
+	if opts.MinAvailability > 0 {
+		filters = append(filters, map[string]interface{}{
+			"or": []interface{}{
+				map[string]interface{}{
+					"missing": map[string]interface{}{
+						"field": "availability",
+					},
+				},
+				map[string]interface{}{
+					"range": map[string]interface{}{
+						"availability": map[string]interface{}{
+							"gte": opts.MinAvailability,
+						},
+					},
+				},
+			},
+		})
+	}
+	if opts.MinSize > 0 || opts.MaxSize > 0 {
+		size := make(map[string]interface{})
+		if opts.MinSize > 0 {
+			size["gte"] = opts.MinSize
+		}
+		if opts.MaxSize > 0 {
+			size["lte"] = opts.MaxSize
+		}
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{
+				"size": size,
+			},
+		})
+	}
+	if !opts.After.IsZero() {
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{
+				"date": map[string]interface{}{
+					"gt": opts.After.Format(time.RFC3339),
+				},
+			},
+		})
+	}
+	if !opts.ShowHidden {
+		filters = append(filters, map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"hidden": true,
+				},
+			},
+		})
+	}
+	if opts.Poster != "" {
+		filters = append(filters, posterFilter(opts.Poster))
+	}
+	if opts.Collapse {
+		filters = append(filters, map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"alternative": true,
+				},
+			},
+		})
+	}
+	filters = append(filters, blacklistFilters(ctx)...)
+	pageFilters := filters
+	if opts.Cursor != nil {
+		pageFilters = append(append(make([]interface{}, 0, len(filters)+1), filters...), opts.Cursor.filter())
+	}
+	if len(pageFilters) == 1 {
+		query["filter"] = pageFilters[0]
+	} else if len(pageFilters) > 1 {
+		query["filter"] = map[string]interface{}{
+			"and": pageFilters,
 		}
 	}
 	b, err := json.Marshal(query)
@@ -233,8 +536,15 @@ func searchBackend(ctx *context, searchQuery string, page int, length int, onlyc
 	if err != nil {
 		panic(err)
 	}
-	results := make([]searchResult, len(esResp.Hits.Hits))
-	for idx, hit := range esResp.Hits.Hits {
+	hits := esResp.Hits.Hits
+	if order == "asc" {
+		// Newer results are fetched oldest first, but shown newest first.
+		for i, j := 0, len(hits)-1; i < j; i, j = i+1, j-1 {
+			hits[i], hits[j] = hits[j], hits[i]
+		}
+	}
+	results := make([]searchResult, len(hits))
+	for idx, hit := range hits {
 		var typesMap map[string]interface{}
 		var parsedHit searchHit
 		sr := searchResult{}
@@ -255,27 +565,28 @@ func searchBackend(ctx *context, searchQuery string, page int, length int, onlyc
 			sr.Completion = fmt.Sprintf("%0.2f%%", parsedHit.Fields.Completion[0]*100)
 			sr.CompletionClass = "text-danger"
 		}
+		if len(parsedHit.Fields.Availability) > 0 {
+			sr.Availability = fmt.Sprintf("%0.2f%%", parsedHit.Fields.Availability[0]*100)
+		}
 		sr.CompletedParts = strconv.Itoa(parsedHit.Fields.Complete[0])
 		sr.TotalParts = strconv.Itoa(parsedHit.Fields.Length[0])
 		t, _ := time.Parse(time.RFC3339, parsedHit.Fields.Date[0])
-		d := time.Now().Sub(t)
-		if d.Minutes() < 90 {
-			sr.Age = fmt.Sprintf("%0.0fm", d.Minutes())
-		} else if d.Hours() < 12 {
-			sr.Age = fmt.Sprintf("%0.0fh", d.Hours())
-		} else {
-			sr.Age = fmt.Sprintf("%0.0fd", d.Hours()/24)
-		}
+		sr.Age = formatAge(t)
 		switch parsedHit.Fields.Group[0] {
 		case "alt.binaries.anime", "alt.binaries.multimedia.anime", "alt.binaries.multimedia.anime.repost", "alt.binaries.multimedia.anime.highspeed":
 			sr.Category = "anime"
 		default:
 			sr.Category = "anime"
 		}
+		if len(parsedHit.Fields.Category) > 0 && parsedHit.Fields.Category[0] != "" {
+			sr.Category = parsedHit.Fields.Category[0]
+		}
+		sr.Hidden = len(parsedHit.Fields.Hidden) > 0 && parsedHit.Fields.Hidden[0]
 		if len(parsedHit.Fields.Group) > 0 {
 			sr.Group = parsedHit.Fields.Group[0]
 		}
 		sr.Date = t.Format(time.UnixDate)
+		sr.Time = t
 		sr.Types = make([]string, 0, 4)
 		keys := make([]string, 0, 4)
 		for k, _ := range typesMap["fields"].(map[string]interface{}) {
@@ -294,8 +605,90 @@ func searchBackend(ctx *context, searchQuery string, page int, length int, onlyc
 		sr.ExtTypes = strings.Join(sr.Types, ", ")
 		sort.Strings(parsedHit.Fields.Group)
 		sr.FullGroup = strings.Join(parsedHit.Fields.Group, ", ")
+		sr.Groups = parsedHit.Fields.Group
+		if len(parsedHit.Fields.Fingerprint) > 0 {
+			sr.Fingerprint = parsedHit.Fields.Fingerprint[0]
+		}
+		if h := parsedHit.Highlight["filename"]; len(h) > 0 {
+			sr.NameHighlight = highlightHTML(strings.TrimSuffix(h[0], "."))
+		}
+		if h := parsedHit.Highlight["subject"]; len(h) > 0 {
+			fragments := make([]string, len(h))
+			for i, f := range h {
+				fragments[i] = highlightHTML(f)
+			}
+			sr.SubjectHighlight = strings.Join(fragments, " &hellip; ")
+		}
+		if anime := ctx.Titles.match(sr.Name); anime != nil {
+			sr.AnimeId = anime.Aid
+			sr.AnimeTitle = anime.Canonical
+		}
 		results[idx] = sr
 
 	}
-	return results, esResp.Hits.Total
+	page := resultPage{Total: esResp.Hits.Total}
+	// Poster and subject patterns can't all be expressed as filters, the
+	// padding fetched makes up for the results left out here.
+	fetched := make([]searchResult, 0, len(results))
+	for _, sr := range results {
+		if sr.UploadId != "" && !ctx.Blacklist.blocked(sr.UploadId, sr.Poster, sr.Subject) {
+			fetched = append(fetched, sr)
+		}
+	}
+	// Whether there are more results past the page.
+	full := len(hits) == size || len(fetched) > opts.Length
+	if len(fetched) > opts.Length {
+		if order == "asc" {
+			// Keep the results next to the cursor, the oldest.
+			fetched = fetched[len(fetched)-opts.Length:]
+		} else {
+			fetched = fetched[:opts.Length]
+		}
+	}
+	results = fetched
+	if len(fetched) > 0 {
+		last := len(fetched) - 1
+		if opts.Cursor == nil {
+			if int64(from+opts.Length) < esResp.Hits.Total {
+				page.Older = cursorAt(fetched, last, false, opts.Cursor)
+			}
+			if from > 0 {
+				page.Newer = cursorAt(fetched, 0, true, opts.Cursor)
+			}
+		} else {
+			// Past a cursor the total only counts the results on one
+			// side of it.
+			page.Total = countResults(ctx, esQuery, filters)
+			if full || !opts.Cursor.Newer {
+				page.Newer = cursorAt(fetched, 0, true, opts.Cursor)
+			}
+			if full || opts.Cursor.Newer {
+				page.Older = cursorAt(fetched, last, false, opts.Cursor)
+			}
+		}
+	}
+	if opts.Collapse {
+		countAlternatives(ctx, results)
+	}
+	// Split the size of each upload into content and par2 recovery data.
+	ids := make([]string, 0, len(results))
+	for _, sr := range results {
+		if sr.UploadId != "" {
+			ids = append(ids, sr.UploadId)
+		}
+	}
+	breakdowns := getFileBreakdowns(ctx, ids)
+	for idx := range results {
+		sr := &results[idx]
+		sr.ContentBytes = sr.Bytes
+		if b, ok := breakdowns[sr.UploadId]; ok {
+			sr.ContentBytes = b.ContentBytes
+			sr.RecoveryBytes = b.RecoveryBytes
+			sr.ExtTypes = b.summary()
+		}
+		sr.ContentSize = ByteSize(sr.ContentBytes).String()
+		sr.RecoverySize = ByteSize(sr.RecoveryBytes).String()
+	}
+	page.Results = results
+	return page, nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type fileMatcher func(name string) bool
+
+// Error message for a selection leaving no files.
+const nothingSelected = "no files matched the selection"
+
+const (
+	// Keep the par2 set of every selected file.
+	RECOVERY_ALL = "all"
+	// Keep only the par2 index files, downloaders fetch volumes on demand.
+	RECOVERY_INDEX = "index"
+	// Strip all par2 files.
+	RECOVERY_NONE = "none"
+)
+
+// fileSelection picks the files of an upload that go into an nzb.
+type fileSelection struct {
+	Ids      map[string]bool
+	Include  []fileMatcher
+	Exclude  []fileMatcher
+	Recovery string
+}
+
+// newFileMatcher compiles a pattern, either a case insensitive glob such
+// as *05*.mkv or a regular expression written as /pattern/.
+func newFileMatcher(pattern string) (fileMatcher, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, strings.ToLower(name))
+		return ok
+	}, nil
+}
+
+func splitFormValues(values []string) []string {
+	split := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				split = append(split, s)
+			}
+		}
+	}
+	return split
+}
+
+// parseFileSelection reads the files, include, exclude and par2 parameters
+// of a request. It returns nil if the request doesn't select any files.
+func parseFileSelection(req *http.Request) (*fileSelection, error) {
+	req.ParseForm()
+	ids := splitFormValues(req.Form["files"])
+	includes := splitFormValues(req.Form["include"])
+	excludes := splitFormValues(req.Form["exclude"])
+	recovery := ""
+	switch req.Form.Get("par2") {
+	case "":
+	case "1", RECOVERY_ALL:
+		recovery = RECOVERY_ALL
+	case RECOVERY_INDEX:
+		recovery = RECOVERY_INDEX
+	case "0", RECOVERY_NONE:
+		recovery = RECOVERY_NONE
+	default:
+		return nil, errors.New("par2 must be all, index or none")
+	}
+	if len(ids) == 0 && len(includes) == 0 && len(excludes) == 0 && recovery == "" {
+		return nil, nil
+	}
+	sel := &fileSelection{
+		Ids:      make(map[string]bool),
+		Recovery: recovery,
+	}
+	for _, id := range ids {
+		sel.Ids[id] = true
+	}
+	for _, p := range includes {
+		m, err := newFileMatcher(p)
+		if err != nil {
+			return nil, err
+		}
+		sel.Include = append(sel.Include, m)
+	}
+	for _, p := range excludes {
+		m, err := newFileMatcher(p)
+		if err != nil {
+			return nil, err
+		}
+		sel.Exclude = append(sel.Exclude, m)
+	}
+	return sel, nil
+}
+
+func (sel *fileSelection) selected(f NzbFile) bool {
+	for _, m := range sel.Exclude {
+		if m(f.Name) {
+			return false
+		}
+	}
+	if len(sel.Ids) == 0 && len(sel.Include) == 0 {
+		return true
+	}
+	if sel.Ids[f.Id] {
+		return true
+	}
+	for _, m := range sel.Include {
+		if m(f.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply filters files down to the selection, keeping their order.
+func (sel *fileSelection) apply(files []NzbFile) []NzbFile {
+	if sel == nil {
+		return files
+	}
+	keep := make([]bool, len(files))
+	sets := make(map[string]bool)
+	for idx, f := range files {
+		keep[idx] = sel.selected(f)
+		if keep[idx] && !isPar2(f.Name) {
+			name := strings.ToLower(strings.TrimSuffix(f.Name, "."))
+			sets[name] = true
+			sets[strings.TrimSuffix(name, path.Ext(name))] = true
+		}
+	}
+	selected := make([]NzbFile, 0, len(files))
+	for idx, f := range files {
+		class := classifyFile(f.Name)
+		if !keep[idx] && (sel.Recovery == RECOVERY_ALL || sel.Recovery == RECOVERY_INDEX) {
+			keep[idx] = isPar2(f.Name) && sets[par2SetName(f.Name)]
+		}
+		if sel.Recovery == RECOVERY_INDEX && class == FILE_PAR2_VOLUMES {
+			keep[idx] = false
+		}
+		if sel.Recovery == RECOVERY_NONE && (class == FILE_PAR2_INDEX || class == FILE_PAR2_VOLUMES) {
+			keep[idx] = false
+		}
+		if keep[idx] {
+			selected = append(selected, f)
+		}
+	}
+	return selected
+}
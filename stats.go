@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Days of uploads counted per day.
+	statsDays = 30
+	// Newest uploads sampled for top posters and indexing lag.
+	statsSample = 1000
+	// Posters listed as top posters.
+	statsPosters = 20
+	// Age at which statistics collected on demand, with refreshing
+	// disabled, are collected again.
+	statsMaxAge = 10 * time.Minute
+)
+
+// Ranges of completion the uploads are counted in.
+var completionRanges = []map[string]interface{}{
+	{"key": "under 50%", "to": 0.5},
+	{"key": "50-90%", "from": 0.5, "to": 0.9},
+	{"key": "90-99%", "from": 0.9, "to": 0.99},
+	{"key": "99-100%", "from": 0.99, "to": 1},
+	{"key": "complete", "from": 1},
+}
+
+// indexStats sums up the whole index.
+type indexStats struct {
+	Updated    time.Time     `json:"updated"`
+	Uploads    int64         `json:"uploads"`
+	Bytes      int64         `json:"bytes"`
+	Size       string        `json:"size"`
+	Days       []statsBucket `json:"days"`
+	Groups     []statsBucket `json:"groups"`
+	Categories []statsBucket `json:"categories"`
+	Completion []statsBucket `json:"completion"`
+	// Posters of the newest uploads.
+	Posters []statsBucket `json:"posters"`
+	// Nil if the index doesn't keep the time uploads were indexed at.
+	Lag *indexLag `json:"lag"`
+}
+
+// statsBucket counts the uploads of a day, newsgroup, category,
+// completion range or poster.
+type statsBucket struct {
+	Name    string `json:"name"`
+	Uploads int64  `json:"uploads"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Size    string `json:"size,omitempty"`
+	// Width of the bucket's bar, relative to the largest bucket.
+	Percent int `json:"-"`
+}
+
+// statsBuckets sorts buckets with the most uploads first.
+type statsBuckets []statsBucket
+
+func (s statsBuckets) Len() int      { return len(s) }
+func (s statsBuckets) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s statsBuckets) Less(i, j int) bool {
+	if s[i].Uploads != s[j].Uploads {
+		return s[i].Uploads > s[j].Uploads
+	}
+	return s[i].Name < s[j].Name
+}
+
+// indexLag is how long after being posted the newest uploads were indexed,
+// in seconds.
+type indexLag struct {
+	Sampled int     `json:"sampled"`
+	Median  float64 `json:"median"`
+	Average float64 `json:"average"`
+	Max     float64 `json:"max"`
+}
+
+// statsCache keeps the last index statistics, so pages showing them don't
+// run the aggregations again.
+type statsCache struct {
+	sync.RWMutex
+	stats *indexStats
+	// Held while collecting on demand.
+	collecting sync.Mutex
+}
+
+func (c *statsCache) get() *indexStats {
+	c.RLock()
+	defer c.RUnlock()
+	return c.stats
+}
+
+func (c *statsCache) set(st *indexStats) {
+	c.Lock()
+	c.stats = st
+	c.Unlock()
+}
+
+func (l *indexLag) MedianText() string {
+	return formatLag(l.Median)
+}
+
+func (l *indexLag) AverageText() string {
+	return formatLag(l.Average)
+}
+
+func (l *indexLag) MaxText() string {
+	return formatLag(l.Max)
+}
+
+func formatLag(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+type sizeBuckets struct {
+	Buckets []struct {
+		Key   json.RawMessage `json:"key"`
+		Name  string          `json:"key_as_string"`
+		Count int64           `json:"doc_count"`
+		Bytes struct {
+			Value float64 `json:"value"`
+		} `json:"bytes"`
+	} `json:"buckets"`
+}
+
+// list turns the buckets into stats buckets, named by their key unless
+// ES named them.
+func (b *sizeBuckets) list() []statsBucket {
+	list := make([]statsBucket, 0, len(b.Buckets))
+	for _, bucket := range b.Buckets {
+		name := bucket.Name
+		if name == "" {
+			json.Unmarshal(bucket.Key, &name)
+		}
+		list = append(list, statsBucket{
+			Name:    name,
+			Uploads: bucket.Count,
+			Bytes:   int64(bucket.Bytes.Value),
+			Size:    ByteSize(int64(bucket.Bytes.Value)).String(),
+		})
+	}
+	return list
+}
+
+// scaleBuckets sets the bar widths of buckets.
+func scaleBuckets(buckets []statsBucket) {
+	var largest int64
+	for _, b := range buckets {
+		if b.Uploads > largest {
+			largest = b.Uploads
+		}
+	}
+	if largest == 0 {
+		return
+	}
+	for i := range buckets {
+		buckets[i].Percent = int(buckets[i].Uploads * 100 / largest)
+	}
+}
+
+// collectStats runs the aggregations of the index statistics.
+func collectStats(ctx *context) (*indexStats, error) {
+	now := time.Now()
+	since := now.AddDate(0, 0, -statsDays)
+	sizeAgg := map[string]interface{}{
+		"bytes": map[string]interface{}{
+			"sum": map[string]interface{}{
+				"field": "size",
+			},
+		},
+	}
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query": map[string]interface{}{
+					"match_all": map[string]interface{}{},
+				},
+				"filter": visibleFilter(ctx),
+			},
+		},
+		"aggs": map[string]interface{}{
+			"bytes": sizeAgg["bytes"],
+			"recent": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"range": map[string]interface{}{
+						"date": map[string]interface{}{
+							"gte": since.Format(time.RFC3339),
+						},
+					},
+				},
+				"aggs": map[string]interface{}{
+					"days": map[string]interface{}{
+						"date_histogram": map[string]interface{}{
+							"field":         "date",
+							"interval":      "day",
+							"format":        "yyyy-MM-dd",
+							"min_doc_count": 0,
+							"extended_bounds": map[string]interface{}{
+								"min": since.UnixNano() / int64(time.Millisecond),
+								"max": now.UnixNano() / int64(time.Millisecond),
+							},
+						},
+						"aggs": sizeAgg,
+					},
+				},
+			},
+			"groups": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": "group",
+					"size":  statsGroups,
+				},
+				"aggs": sizeAgg,
+			},
+			"categories": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": "category",
+				},
+				"aggs": sizeAgg,
+			},
+			// Uploads without a category are anime.
+			"uncategorized": map[string]interface{}{
+				"missing": map[string]interface{}{
+					"field": "category",
+				},
+				"aggs": sizeAgg,
+			},
+			"completion": map[string]interface{}{
+				"range": map[string]interface{}{
+					"field":  "completion",
+					"ranges": completionRanges,
+				},
+				"aggs": sizeAgg,
+			},
+		},
+		"size": 0,
+	}
+	var esResp struct {
+		Hits struct {
+			Total int64 `json:"total"`
+		} `json:"hits"`
+		Aggregations struct {
+			Bytes struct {
+				Value float64 `json:"value"`
+			} `json:"bytes"`
+			Recent struct {
+				Days sizeBuckets `json:"days"`
+			} `json:"recent"`
+			Groups        sizeBuckets `json:"groups"`
+			Categories    sizeBuckets `json:"categories"`
+			Completion    sizeBuckets `json:"completion"`
+			Uncategorized struct {
+				Count int64 `json:"doc_count"`
+				Bytes struct {
+					Value float64 `json:"value"`
+				} `json:"bytes"`
+			} `json:"uncategorized"`
+		} `json:"aggregations"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", body, &esResp); err != nil {
+		return nil, err
+	}
+	aggs := esResp.Aggregations
+	st := &indexStats{
+		Updated:    now,
+		Uploads:    esResp.Hits.Total,
+		Bytes:      int64(aggs.Bytes.Value),
+		Size:       ByteSize(int64(aggs.Bytes.Value)).String(),
+		Days:       aggs.Recent.Days.list(),
+		Groups:     aggs.Groups.list(),
+		Categories: aggs.Categories.list(),
+		Completion: aggs.Completion.list(),
+	}
+	if n := aggs.Uncategorized.Count; n > 0 {
+		bytes := int64(aggs.Uncategorized.Bytes.Value)
+		found := false
+		for i, c := range st.Categories {
+			if c.Name == "anime" {
+				st.Categories[i].Uploads += n
+				st.Categories[i].Bytes += bytes
+				st.Categories[i].Size = ByteSize(st.Categories[i].Bytes).String()
+				found = true
+			}
+		}
+		if !found {
+			st.Categories = append(st.Categories, statsBucket{Name: "anime", Uploads: n, Bytes: bytes, Size: ByteSize(bytes).String()})
+		}
+		sort.Sort(statsBuckets(st.Categories))
+	}
+	var err error
+	if st.Posters, st.Lag, err = sampleUploads(ctx); err != nil {
+		return nil, err
+	}
+	for _, buckets := range [][]statsBucket{st.Days, st.Groups, st.Categories, st.Completion, st.Posters} {
+		scaleBuckets(buckets)
+	}
+	return st, nil
+}
+
+// sampleUploads counts the posters of the newest uploads and how long
+// after being posted they were indexed. Posters are counted here rather
+// than aggregated as poster is analyzed, and the lag needs the _timestamp
+// of uploads, which is only kept when enabled on the upload mapping.
+func sampleUploads(ctx *context) ([]statsBucket, *indexLag, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query": map[string]interface{}{
+					"match_all": map[string]interface{}{},
+				},
+				"filter": visibleFilter(ctx),
+			},
+		},
+		"sort": []interface{}{
+			map[string]interface{}{
+				"date": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+		},
+		"size":    statsSample,
+		"_source": []string{"poster", "date"},
+		"fields":  []string{"_timestamp"},
+	}
+	var esResp struct {
+		Hits struct {
+			Hits []struct {
+				Source struct {
+					Poster string    `json:"poster"`
+					Date   time.Time `json:"date"`
+				} `json:"_source"`
+				Fields struct {
+					Timestamp *float64 `json:"_timestamp"`
+				} `json:"fields"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		return nil, nil, err
+	}
+	counts := make(map[string]int64)
+	lags := make([]float64, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		if hit.Source.Poster != "" && !ctx.Blacklist.posterBlocked(hit.Source.Poster) {
+			counts[hit.Source.Poster]++
+		}
+		if hit.Fields.Timestamp != nil && !hit.Source.Date.IsZero() {
+			lag := esTime(*hit.Fields.Timestamp).Sub(hit.Source.Date).Seconds()
+			if lag < 0 {
+				lag = 0
+			}
+			lags = append(lags, lag)
+		}
+	}
+
+	posters := make([]statsBucket, 0, len(counts))
+	for name, n := range counts {
+		posters = append(posters, statsBucket{Name: name, Uploads: n})
+	}
+	sort.Sort(statsBuckets(posters))
+	if len(posters) > statsPosters {
+		posters = posters[:statsPosters]
+	}
+
+	if len(lags) == 0 {
+		return posters, nil, nil
+	}
+	sort.Float64s(lags)
+	lag := &indexLag{
+		Sampled: len(lags),
+		Median:  lags[len(lags)/2],
+		Max:     lags[len(lags)-1],
+	}
+	for _, l := range lags {
+		lag.Average += l
+	}
+	lag.Average /= float64(len(lags))
+	return posters, lag, nil
+}
+
+// refreshStats collects the index statistics periodically.
+func refreshStats(ctx *context, interval time.Duration) {
+	for {
+		if st, err := collectStats(ctx); err == nil {
+			ctx.Stats.set(st)
+		} else {
+			log.Printf("Failed to collect index statistics: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// currentStats returns the cached index statistics. With refreshing
+// disabled they are collected on demand, and nil until first collected
+// otherwise.
+func currentStats(ctx *context) *indexStats {
+	st := ctx.Stats.get()
+	if statsInterval > 0 || (st != nil && time.Since(st.Updated) < statsMaxAge) {
+		return st
+	}
+	ctx.Stats.collecting.Lock()
+	defer ctx.Stats.collecting.Unlock()
+	if st = ctx.Stats.get(); st != nil && time.Since(st.Updated) < statsMaxAge {
+		return st
+	}
+	fresh, err := collectStats(ctx)
+	if err != nil {
+		log.Printf("Failed to collect index statistics: %s", err)
+		return st
+	}
+	ctx.Stats.set(fresh)
+	return fresh
+}
+
+// getStats serves the index statistics as json.
+func getStats(ctx *context, res http.ResponseWriter) {
+	st := currentStats(ctx)
+	if st == nil {
+		jsonError(res, 503, "index statistics aren't available yet")
+		return
+	}
+	writeJson(res, 200, st)
+}
+
+// statsPage serves the index statistics as html or, with format=json, as
+// json. Until they are collected the page says so.
+func statsPage(ctx *context, res http.ResponseWriter, req *http.Request) {
+	if wantsJson(req) {
+		getStats(ctx, res)
+		return
+	}
+	st := currentStats(ctx)
+	ready := st != nil
+	if !ready {
+		st = &indexStats{}
+	}
+	res.Header().Set("Content-Type", "text/html")
+	renderTemplate(res, "stats.html", struct {
+		*indexStats
+		Ready   bool
+		Base    string
+		UrlPath func(string) string
+	}{st, ready, ctx.urls(req).Prefix, urlPath})
+}
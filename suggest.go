@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Suggestions returned per request.
+	suggestLimit = 10
+	// Recent uploads whose titles, groups and posters are considered.
+	suggestSample = 200
+	// One typo is tolerated for every this many letters typed...
+	suggestTypoSpan = 4
+	// ...up to this many.
+	maxSuggestTypos = 2
+)
+
+const (
+	SUGGEST_TITLE  = "title"
+	SUGGEST_GROUP  = "group"
+	SUGGEST_POSTER = "poster"
+)
+
+type suggestion struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// What to search for to find the uploads of Value.
+	Query   string `json:"query"`
+	Uploads int    `json:"uploads"`
+	AnimeId int    `json:"aid,omitempty"`
+
+	// How closely Value matches what was typed, lower is better.
+	score int
+	// Position of the newest matching upload, to break ties.
+	newest int
+}
+
+type suggestions []suggestion
+
+func (s suggestions) Len() int      { return len(s) }
+func (s suggestions) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s suggestions) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score < s[j].score
+	}
+	if s[i].Uploads != s[j].Uploads {
+		return s[i].Uploads > s[j].Uploads
+	}
+	return s[i].newest < s[j].newest
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a []rune, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// matchScore ranks how well a normalized name completes what was typed: 0
+// when the name starts with it, 1 when a later word does and one more for
+// every typo beyond that. Like ElasticSearch, typos are only forgiven
+// after the first letter of a word.
+func matchScore(name string, typed string) (int, bool) {
+	if strings.HasPrefix(name, typed) {
+		return 0, true
+	}
+	if strings.Contains(name, " "+typed) {
+		return 1, true
+	}
+	typos := utf8.RuneCountInString(typed) / suggestTypoSpan
+	if typos > maxSuggestTypos {
+		typos = maxSuggestTypos
+	}
+	if typos == 0 {
+		return 0, false
+	}
+	t, n := []rune(typed), []rune(name)
+	best := typos + 1
+	for i := range n {
+		if (i > 0 && n[i-1] != ' ') || n[i] != t[0] {
+			continue
+		}
+		// Letters typed twice or left out change the length of the prefix.
+		for l := len(t) - typos; l <= len(t)+typos && i+l <= len(n); l++ {
+			if d := editDistance(n[i:i+l], t); d < best {
+				best = d
+			}
+		}
+	}
+	if best > typos {
+		return 0, false
+	}
+	return 1 + best, true
+}
+
+// suggestAnime completes what was typed to the titles of the AniDB title
+// index, one per anime. Only names with a word starting with the first
+// letter typed can match, so only those are scored.
+func suggestAnime(ti *titleIndex, typed string, limit int) suggestions {
+	byAnime := make(map[int]int)
+	found := make(suggestions, 0, limit)
+	initial, _ := utf8.DecodeRuneInString(typed)
+	ti.RLock()
+	for _, name := range ti.byInitial[initial] {
+		score, ok := matchScore(name, typed)
+		if !ok {
+			continue
+		}
+		for _, e := range ti.byName[name] {
+			if i, ok := byAnime[e.Aid]; ok {
+				if score < found[i].score {
+					found[i].score = score
+				}
+				continue
+			}
+			byAnime[e.Aid] = len(found)
+			found = append(found, suggestion{
+				Type:    SUGGEST_TITLE,
+				Value:   e.Canonical,
+				Query:   e.Canonical,
+				AnimeId: e.Aid,
+				score:   score,
+				newest:  suggestSample,
+			})
+		}
+	}
+	ti.RUnlock()
+	sort.Sort(found)
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// suggest completes what was typed in the search box to the release
+// titles, release groups and posters of recent uploads, and to known anime
+// titles, best match first. A few typos are tolerated.
+func suggest(ctx *context, typed string, limit int) suggestions {
+	norm := normalizeTitle(typed)
+	if norm == "" {
+		return suggestions{}
+	}
+	should := []map[string]interface{}{}
+	for _, field := range []string{"filename", "poster"} {
+		should = append(should, map[string]interface{}{
+			"match_phrase_prefix": map[string]interface{}{
+				field: map[string]interface{}{
+					"query":          norm,
+					"max_expansions": 50,
+				},
+			},
+		}, map[string]interface{}{
+			"match": map[string]interface{}{
+				field: map[string]interface{}{
+					"query":         norm,
+					"fuzziness":     "AUTO",
+					"prefix_length": 1,
+				},
+			},
+		})
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": should,
+			},
+		},
+		"filter": map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": map[string]interface{}{
+					"hidden": true,
+				},
+			},
+		},
+		"sort": []map[string]string{
+			map[string]string{
+				"date": "desc",
+			},
+		},
+		"size":    suggestSample,
+		"_source": []string{"filename", "poster", "subject"},
+	}
+	var esResp esSourceResp
+	if err := esRequest(ctx, "POST", "/nzb/upload/_search", query, &esResp); err != nil {
+		panic(err)
+	}
+
+	found := make(suggestions, 0, limit)
+	byKey := make(map[string]int)
+	add := func(kind string, value string, query string, idx int) {
+		key := normalizeTitle(value)
+		if key == "" {
+			return
+		}
+		score, ok := matchScore(key, norm)
+		if !ok {
+			return
+		}
+		if i, ok := byKey[kind+" "+key]; ok {
+			found[i].Uploads++
+			return
+		}
+		byKey[kind+" "+key] = len(found)
+		found = append(found, suggestion{Type: kind, Value: value, Query: query, Uploads: 1, score: score, newest: idx})
+	}
+	for idx, hit := range esResp.Hits.Hits {
+		var u uploadDoc
+		if json.Unmarshal(hit.Source, &u) != nil || ctx.Blacklist.blocked(hit.Id, u.Poster, u.Subject) {
+			continue
+		}
+		release := parseRelease(u.Filename)
+		add(SUGGEST_TITLE, release.Title, release.Title, idx)
+		add(SUGGEST_GROUP, release.Group, "group:"+quotePhrase(release.Group), idx)
+		add(SUGGEST_POSTER, u.Poster, "poster:"+quotePhrase(u.Poster), idx)
+	}
+	for i := range found {
+		if found[i].Type != SUGGEST_TITLE {
+			continue
+		}
+		if entries := ctx.Titles.lookup(found[i].Value); len(entries) > 0 {
+			found[i].AnimeId = entries[0].Aid
+		}
+	}
+	// Known titles nothing was uploaded for recently are still worth
+	// completing to, they are often what a misspelling was meant to be.
+	for _, s := range suggestAnime(ctx.Titles, norm, limit) {
+		if _, ok := byKey[SUGGEST_TITLE+" "+normalizeTitle(s.Value)]; !ok {
+			found = append(found, s)
+		}
+	}
+	sort.Sort(found)
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// getSuggestions completes what was typed in the search box.
+func getSuggestions(ctx *context, res http.ResponseWriter, req *http.Request) {
+	limit := suggestLimit
+	if n, err := strconv.Atoi(req.FormValue("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	q := req.FormValue("q")
+	writeJson(res, 200, struct {
+		Query       string      `json:"query"`
+		Suggestions suggestions `json:"suggestions"`
+	}{q, suggest(ctx, q, limit)})
+}
+
+// opensearchSuggest answers browser search suggestions, in the OpenSearch
+// suggestions format: [query, [completions], [descriptions], [urls]].
+func opensearchSuggest(ctx *context, res http.ResponseWriter, req *http.Request) {
+	q := req.FormValue("q")
+	urls := ctx.urls(req)
+	completions := make([]string, 0, suggestLimit)
+	descriptions := make([]string, 0, suggestLimit)
+	links := make([]string, 0, suggestLimit)
+	for _, s := range suggest(ctx, q, suggestLimit) {
+		completions = append(completions, s.Query)
+		switch s.Uploads {
+		case 0:
+			descriptions = append(descriptions, s.Type)
+		case 1:
+			descriptions = append(descriptions, s.Type+", 1 upload")
+		default:
+			descriptions = append(descriptions, s.Type+", "+strconv.Itoa(s.Uploads)+" uploads")
+		}
+		links = append(links, urls.Abs("/?q="+url.QueryEscape(s.Query)))
+	}
+	output, err := json.Marshal([]interface{}{q, completions, descriptions, links})
+	if err != nil {
+		panic(err)
+	}
+	res.Header().Set("Content-Type", "application/x-suggestions+json")
+	res.WriteHeader(200)
+	res.Write(output)
+}
+
+// opensearchDescription lets browsers add animezb as a search engine.
+func opensearchDescription(ctx *context, res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	renderTemplate(res, "opensearch.xml", struct {
+		Root string
+	}{ctx.urls(req).Abs("")})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Longest alias, in words, that will be matched against a query.
+	maxTitleWords = 16
+	// Upper bound on the number of aliases a single query term expands to.
+	maxTitleAliases = 24
+	// Titles shorter than this ("K", "AoT") are too ambiguous to match on.
+	minTitleLength = 4
+)
+
+type animeEntry struct {
+	Aid       int      `json:"aid"`
+	Canonical string   `json:"title"`
+	Titles    []string `json:"titles"`
+}
+
+// titleIndex is an in memory index of anime titles imported from an
+// AniDB titles dump. Every title is keyed by its normalized form so that
+// "Shingeki no Kyojin" and "shingeki-no-kyojin" resolve to the same anime.
+type titleIndex struct {
+	sync.RWMutex
+	anime    map[int]*animeEntry
+	byName   map[string][]*animeEntry
+	maxWords int
+	// Normalized names by the first letter of each of their words, the
+	// names a suggestion can complete.
+	byInitial map[rune][]string
+}
+
+type anidbTitles struct {
+	Anime []struct {
+		Aid    int `xml:"aid,attr"`
+		Titles []struct {
+			Type  string `xml:"type,attr"`
+			Lang  string `xml:"lang,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"title"`
+	} `xml:"anime"`
+}
+
+func newTitleIndex() *titleIndex {
+	return &titleIndex{
+		anime:     make(map[int]*animeEntry),
+		byName:    make(map[string][]*animeEntry),
+		byInitial: make(map[rune][]string),
+	}
+}
+
+// importTitles reads an AniDB titles dump in either the XML
+// (anime-titles.xml) or DAT (anime-titles.dat) format, optionally gzipped,
+// and replaces the contents of the index with it.
+func (ti *titleIndex) importTitles(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = bufio.NewReader(gz)
+	}
+	br := r.(*bufio.Reader)
+	skipBom(br)
+
+	anime := make(map[int]*animeEntry)
+	add := func(aid int, titleType string, title string) {
+		title = strings.TrimSpace(title)
+		if title == "" {
+			return
+		}
+		e, ok := anime[aid]
+		if !ok {
+			e = &animeEntry{Aid: aid}
+			anime[aid] = e
+		}
+		if titleType == "main" || titleType == "1" {
+			e.Canonical = title
+		}
+		e.Titles = append(e.Titles, title)
+	}
+
+	first, err := firstNonSpace(br)
+	if err != nil {
+		return 0, err
+	}
+	if first == '<' {
+		var dump anidbTitles
+		if err := xml.NewDecoder(br).Decode(&dump); err != nil {
+			return 0, err
+		}
+		for _, a := range dump.Anime {
+			for _, t := range a.Titles {
+				add(a.Aid, t.Type, t.Value)
+			}
+		}
+	} else {
+		// aid|type|language|title
+		scanner := bufio.NewScanner(br)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, "|", 4)
+			if len(parts) != 4 {
+				continue
+			}
+			aid, err := strconv.Atoi(parts[0])
+			if err != nil {
+				continue
+			}
+			add(aid, parts[1], parts[3])
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if len(anime) == 0 {
+		return 0, errors.New("no titles found in " + path)
+	}
+
+	byName := make(map[string][]*animeEntry)
+	maxWords := 0
+	for _, e := range anime {
+		if e.Canonical == "" {
+			e.Canonical = e.Titles[0]
+		}
+		seen := make(map[string]bool)
+		for _, t := range e.Titles {
+			n := normalizeTitle(t)
+			if n == "" || seen[n] {
+				continue
+			}
+			seen[n] = true
+			byName[n] = append(byName[n], e)
+			if words := strings.Count(n, " ") + 1; words > maxWords {
+				maxWords = words
+			}
+		}
+	}
+	if maxWords > maxTitleWords {
+		maxWords = maxTitleWords
+	}
+	byInitial := make(map[rune][]string)
+	for n := range byName {
+		initials := make(map[rune]bool)
+		for _, word := range strings.Fields(n) {
+			r, _ := utf8.DecodeRuneInString(word)
+			if !initials[r] {
+				initials[r] = true
+				byInitial[r] = append(byInitial[r], n)
+			}
+		}
+	}
+
+	ti.Lock()
+	ti.anime = anime
+	ti.byName = byName
+	ti.byInitial = byInitial
+	ti.maxWords = maxWords
+	ti.Unlock()
+	return len(anime), nil
+}
+
+// skipBom consumes the UTF-8 byte order mark some dumps start with.
+func skipBom(br *bufio.Reader) {
+	if b, err := br.Peek(3); err == nil && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf {
+		br.Discard(3)
+	}
+}
+
+func firstNonSpace(br *bufio.Reader) (byte, error) {
+	for i := 1; ; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return 0, err
+		}
+		if c := b[i-1]; c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+// normalizeTitle lowercases a title and collapses everything that isn't a
+// letter or a digit into single spaces.
+func normalizeTitle(s string) string {
+	var buf bytes.Buffer
+	space := true
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			buf.WriteRune(r)
+			space = false
+		} else if r == '\'' || r == '`' {
+			continue
+		} else if !space {
+			buf.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func (ti *titleIndex) get(aid int) *animeEntry {
+	ti.RLock()
+	defer ti.RUnlock()
+	return ti.anime[aid]
+}
+
+func (ti *titleIndex) lookup(name string) []*animeEntry {
+	ti.RLock()
+	defer ti.RUnlock()
+	return ti.byName[normalizeTitle(name)]
+}
+
+func (ti *titleIndex) size() int {
+	ti.RLock()
+	defer ti.RUnlock()
+	return len(ti.anime)
+}
+
+// longestMatch finds the longest run of words, starting at words[start],
+// that is a known title.
+func (ti *titleIndex) longestMatch(words []string, start int) ([]*animeEntry, int) {
+	end := start + ti.maxWords
+	if end > len(words) {
+		end = len(words)
+	}
+	for ; end > start; end-- {
+		name := strings.Join(words[start:end], " ")
+		if len(name) < minTitleLength {
+			break
+		}
+		if e, ok := ti.byName[name]; ok {
+			return e, end
+		}
+	}
+	return nil, start
+}
+
+// match returns the anime a release name refers to, if any. When several
+// titles appear in the name the longest one wins.
+func (ti *titleIndex) match(name string) *animeEntry {
+	words := strings.Fields(normalizeTitle(stripBrackets(name)))
+	ti.RLock()
+	defer ti.RUnlock()
+	var best *animeEntry
+	bestLen := 0
+	for i := range words {
+		if e, end := ti.longestMatch(words, i); e != nil && end-i > bestLen {
+			best, bestLen = e[0], end-i
+		}
+	}
+	return best
+}
+
+func stripBrackets(s string) string {
+	var buf bytes.Buffer
+	depth := 0
+	for _, r := range s {
+		switch r {
+		case '[', '(', '{':
+			depth++
+			buf.WriteByte(' ')
+		case ']', ')', '}':
+			if depth > 0 {
+				depth--
+			}
+			buf.WriteByte(' ')
+		default:
+			if depth == 0 {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// titleRun is a run of query words that names a known anime.
+type titleRun struct {
+	Start int
+	End   int
+	// Every title of the anime, the words typed first.
+	Aliases []string
+}
+
+// expandWords finds the runs of words, each already normalized, that name
+// a known anime, so that searching for one of its titles finds uploads
+// named after any of the others.
+func (ti *titleIndex) expandWords(words []string) []titleRun {
+	ti.RLock()
+	defer ti.RUnlock()
+	runs := make([]titleRun, 0, 1)
+	for i := 0; i < len(words); {
+		entries, end := ti.longestMatch(words, i)
+		if entries == nil {
+			i++
+			continue
+		}
+		runs = append(runs, titleRun{
+			Start:   i,
+			End:     end,
+			Aliases: titleAliases(entries, strings.Join(words[i:end], " ")),
+		})
+		i = end
+	}
+	return runs
+}
+
+func titleAliases(entries []*animeEntry, matched string) []string {
+	seen := map[string]bool{matched: true}
+	aliases := make([]string, 0, maxTitleAliases)
+	for _, e := range entries {
+		for _, t := range e.Titles {
+			n := normalizeTitle(t)
+			if n == "" || seen[n] {
+				continue
+			}
+			seen[n] = true
+			aliases = append(aliases, n)
+		}
+	}
+	sort.Strings(aliases)
+	// The words the user actually typed always survive the cut.
+	aliases = append([]string{matched}, aliases...)
+	if len(aliases) > maxTitleAliases {
+		aliases = aliases[:maxTitleAliases]
+	}
+	return aliases
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	testTitlesXml = `<?xml version="1.0" encoding="UTF-8"?>
+<animetitles>
+	<anime aid="1">
+		<title xml:lang="x-jat" type="main">Shingeki no Kyojin</title>
+		<title xml:lang="en" type="official">Attack on Titan</title>
+		<title xml:lang="en" type="short">AoT</title>
+	</anime>
+	<anime aid="2">
+		<title xml:lang="x-jat" type="main">Shingeki no Kyojin Season 2</title>
+	</anime>
+</animetitles>
+`
+	testTitlesDat = `# created: Sun Oct 18 2026
+1|1|x-jat|Shingeki no Kyojin
+1|4|en|Attack on Titan
+1|2|en|AoT
+2|1|x-jat|Shingeki no Kyojin Season 2
+`
+)
+
+var bom = "\xef\xbb\xbf"
+
+// importTestTitles imports a titles dump written to a temporary file,
+// gzipped if asked to.
+func importTestTitles(t *testing.T, dump string, gz bool) (*titleIndex, int, error) {
+	dir, err := ioutil.TempDir("", "titles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte(dump)
+	if gz {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		data = buf.Bytes()
+	}
+	path := filepath.Join(dir, "anime-titles")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ti := newTitleIndex()
+	n, err := ti.importTitles(path)
+	return ti, n, err
+}
+
+func TestImportTitles(t *testing.T) {
+	tests := []struct {
+		name string
+		dump string
+		gz   bool
+	}{
+		{"xml", testTitlesXml, false},
+		{"gzipped xml", testTitlesXml, true},
+		{"xml with a bom", bom + testTitlesXml, false},
+		{"gzipped xml with a bom", bom + testTitlesXml, true},
+		{"dat", testTitlesDat, false},
+		{"gzipped dat", testTitlesDat, true},
+		{"dat with a bom", bom + strings.SplitN(testTitlesDat, "\n", 2)[1], false},
+		{"dat with a bom and crlf", bom + strings.Replace(testTitlesDat, "\n", "\r\n", -1), true},
+	}
+	for _, test := range tests {
+		ti, n, err := importTestTitles(t, test.dump, test.gz)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if n != 2 || ti.size() != 2 {
+			t.Errorf("%s: imported %d anime, want 2", test.name, n)
+		}
+		e := ti.get(1)
+		if e == nil {
+			t.Errorf("%s: anime 1 is missing", test.name)
+			continue
+		}
+		if e.Canonical != "Shingeki no Kyojin" {
+			t.Errorf("%s: canonical title %q, want Shingeki no Kyojin", test.name, e.Canonical)
+		}
+		if want := []string{"Shingeki no Kyojin", "Attack on Titan", "AoT"}; !reflect.DeepEqual(e.Titles, want) {
+			t.Errorf("%s: titles %q, want %q", test.name, e.Titles, want)
+		}
+		if found := ti.lookup("attack-on-titan"); len(found) != 1 || found[0].Aid != 1 {
+			t.Errorf("%s: lookup of attack-on-titan found %v", test.name, found)
+		}
+	}
+}
+
+func TestImportTitlesRejects(t *testing.T) {
+	for _, dump := range []string{"", bom, "# only a comment\n", "not|a|dump\n", "<animetitles></animetitles>", "\xbb" + testTitlesXml} {
+		if _, n, err := importTestTitles(t, dump, false); err == nil {
+			t.Errorf("import of %q succeeded with %d anime", dump, n)
+		}
+	}
+}
+
+func TestExpandWords(t *testing.T) {
+	ti, _, err := importTestTitles(t, testTitlesDat, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		runs  []titleRun
+	}{
+		{"attack on titan 1080p", []titleRun{
+			{0, 3, []string{"attack on titan", "aot", "shingeki no kyojin"}},
+		}},
+		{"horriblesubs shingeki no kyojin season 2", []titleRun{
+			{1, 6, []string{"shingeki no kyojin season 2"}},
+		}},
+		{"shingeki no kyojin attack on titan", []titleRun{
+			{0, 3, []string{"shingeki no kyojin", "aot", "attack on titan"}},
+			{3, 6, []string{"attack on titan", "aot", "shingeki no kyojin"}},
+		}},
+		// Too short to match on.
+		{"aot", []titleRun{}},
+		{"attack on", []titleRun{}},
+	}
+	for _, test := range tests {
+		runs := ti.expandWords(strings.Fields(normalizeTitle(test.query)))
+		if !reflect.DeepEqual(runs, test.runs) {
+			t.Errorf("expandWords(%q) = %+v, want %+v", test.query, runs, test.runs)
+		}
+	}
+}
+
+func TestExpandWordsLimit(t *testing.T) {
+	var dump bytes.Buffer
+	for i := 0; i < maxTitleAliases*2; i++ {
+		dump.WriteString("1|4|en|Zeta Title " + strconv.Itoa(i) + "\n")
+	}
+	dump.WriteString("1|1|x-jat|Alpha Title\n")
+	ti, _, err := importTestTitles(t, dump.String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := ti.expandWords([]string{"zeta", "title", "47"})
+	if len(runs) != 1 {
+		t.Fatalf("expandWords found %+v, want one run", runs)
+	}
+	aliases := runs[0].Aliases
+	if len(aliases) != maxTitleAliases || aliases[0] != "zeta title 47" || aliases[1] != "alpha title" {
+		t.Errorf("aliases = %q, want %d starting with the typed title", aliases, maxTitleAliases)
+	}
+}
+
+func TestMatchTitle(t *testing.T) {
+	ti, _, err := importTestTitles(t, testTitlesXml, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		aid  int
+	}{
+		{"[Group] Shingeki no Kyojin - 01 [1080p].mkv", 1},
+		{"[Group] Shingeki no Kyojin Season 2 - 01 [1080p].mkv", 2},
+		{"Attack.on.Titan.S01E01.720p.mkv", 1},
+		{"[Attack on Titan] Something Else - 01.mkv", 0},
+		{"AoT - 01.mkv", 0},
+	}
+	for _, test := range tests {
+		aid := 0
+		if e := ti.match(test.name); e != nil {
+			aid = e.Aid
+		}
+		if aid != test.aid {
+			t.Errorf("match(%q) = anime %d, want %d", test.name, aid, test.aid)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the certificate in certFile and keyFile, reloading
+// it when either changes or on SIGHUP, so renewed certificates are picked
+// up without a restart.
+type certReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the latest modification time of the certificate files.
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	mod, err := r.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.cert = &cert
+	r.modTime = mod
+	r.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate on SIGHUP and when the files change. A
+// failed reload keeps the current certificate.
+func (r *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case <-hup:
+		case <-tick.C:
+			mod, err := r.modified()
+			r.RLock()
+			changed := err == nil && !mod.Equal(r.modTime)
+			r.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+		if err := r.reload(); err == nil {
+			log.Printf("Reloaded TLS certificate %s", r.certFile)
+		} else {
+			log.Printf("Failed to reload TLS certificate: %s", err)
+		}
+	}
+}
+
+// newTLSConfig serves certificates from r over HTTP/2 or HTTP/1.1.
+func newTLSConfig(r *certReloader, minVersion string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+	}
+	return &tls.Config{
+		MinVersion:     version,
+		GetCertificate: r.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// redirectToHttps sends plain http requests to the TLS listener, or to the
+// public url if it is an https one. Requests a trusted proxy already
+// received over https are left alone.
+func redirectToHttps(ctx *context, res http.ResponseWriter, req *http.Request) {
+	if ctx.Proxies.scheme(req) == "https" {
+		return
+	}
+	var target string
+	if ctx.Urls.configured && ctx.Urls.Scheme == "https" {
+		target = ctx.Urls.Abs(req.URL.RequestURI())
+	} else {
+		host := ctx.Proxies.host(req)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		target = "https://" + host + req.RequestURI
+	}
+	status := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		// Clients may follow a 301 with a GET, a 308 keeps the method
+		// and body.
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(res, req, target, status)
+}
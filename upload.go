@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/martini"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Related uploads listed for an upload.
+const relatedUploads = 10
+
+var sampleRe = regexp.MustCompile(`(?i)(^|[^a-z])sample([^a-z]|$)`)
+
+type uploadDoc struct {
+	Subject      string         `json:"subject"`
+	Poster       string         `json:"poster"`
+	Filename     string         `json:"filename"`
+	FilePrefix   string         `json:"fileprefix"`
+	Group        []string       `json:"group"`
+	Date         time.Time      `json:"date"`
+	Size         int64          `json:"size"`
+	Complete     int            `json:"complete"`
+	Length       int            `json:"length"`
+	Completion   float64        `json:"completion"`
+	Types        map[string]int `json:"types"`
+	Availability *float64       `json:"availability"`
+	Fingerprint  string         `json:"fingerprint"`
+	Hidden       bool           `json:"hidden"`
+	Blacklisted  bool           `json:"blacklisted"`
+	Category     string         `json:"category"`
+}
+
+type uploadDetail struct {
+	Id             string         `json:"id"`
+	Name           string         `json:"name"`
+	Subject        string         `json:"subject"`
+	Release        releaseInfo    `json:"release"`
+	AnimeId        int            `json:"anidbid,omitempty"`
+	AnimeTitle     string         `json:"animetitle,omitempty"`
+	Posters        []string       `json:"posters"`
+	Groups         []string       `json:"groups"`
+	Date           time.Time      `json:"date"`
+	Age            string         `json:"age"`
+	Bytes          int64          `json:"bytes"`
+	Size           string         `json:"size"`
+	ContentBytes   int64          `json:"contentbytes"`
+	ContentSize    string         `json:"contentsize"`
+	CompletedParts int            `json:"complete"`
+	TotalParts     int            `json:"length"`
+	Completion     string         `json:"completion"`
+	Availability   string         `json:"availability,omitempty"`
+	Files          []detailFile   `json:"files"`
+	Samples        []detailFile   `json:"samples"`
+	Nfo            *nfoInfo       `json:"nfo"`
+	Par2           par2Totals     `json:"par2"`
+	Related        []relatedEntry `json:"related"`
+	Links          uploadLinks    `json:"links"`
+}
+
+type detailFile struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Subject    string `json:"subject"`
+	Class      string `json:"class"`
+	Parts      int    `json:"parts"`
+	Length     int    `json:"length"`
+	Completion string `json:"completion"`
+	Complete   bool   `json:"-"`
+	Bytes      int64  `json:"bytes"`
+	Size       string `json:"size"`
+	Date       string `json:"date"`
+	Sample     bool   `json:"sample"`
+	// Nzb of only this file, for samples.
+	Nzb string `json:"nzb,omitempty"`
+}
+
+type par2Totals struct {
+	IndexFiles int    `json:"index"`
+	Volumes    int    `json:"volumes"`
+	Blocks     int    `json:"blocks"`
+	Bytes      int64  `json:"bytes"`
+	Size       string `json:"size"`
+}
+
+type relatedEntry struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Group      string `json:"group,omitempty"`
+	Poster     string `json:"poster"`
+	Size       string `json:"size"`
+	Age        string `json:"age"`
+	Completion string `json:"completion"`
+	Details    string `json:"details"`
+	SamePoster bool   `json:"sameposter"`
+	SameSeries bool   `json:"sameseries"`
+}
+
+type uploadLinks struct {
+	Details string `json:"details"`
+	Nzb     string `json:"nzb"`
+}
+
+type detailFiles []detailFile
+
+func (s detailFiles) Len() int           { return len(s) }
+func (s detailFiles) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s detailFiles) Less(i, j int) bool { return s[i].Subject < s[j].Subject }
+
+func getUpload(ctx *context, uploadId string) (*uploadDoc, error) {
+	var esResp struct {
+		Source uploadDoc `json:"_source"`
+	}
+	if err := esRequest(ctx, "GET", "/nzb/upload/"+uploadId, nil, &esResp); err != nil {
+		return nil, err
+	}
+	return &esResp.Source, nil
+}
+
+func wantsJson(req *http.Request) bool {
+	return req.FormValue("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// getUploadDetail serves the detail page of an upload, as html or, with
+// format=json, as json.
+func getUploadDetail(ctx *context, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	uploadId := params["nzbid"]
+	upload, err := getUpload(ctx, uploadId)
+	if err != nil {
+		if isNotFound(err) {
+			jsonError(res, 404, "no such upload")
+			return
+		}
+		panic(err)
+	}
+	d := uploadDetail{
+		Id:             uploadId,
+		Name:           strings.TrimSuffix(upload.FilePrefix, "."),
+		Subject:        upload.Subject,
+		Date:           upload.Date,
+		Age:            formatAge(upload.Date),
+		Bytes:          upload.Size,
+		Size:           ByteSize(upload.Size).String(),
+		CompletedParts: upload.Complete,
+		TotalParts:     upload.Length,
+		Groups:         upload.Group,
+	}
+	if d.Name == "" {
+		d.Name = strings.TrimSuffix(upload.Filename, ".")
+	}
+	d.Release = parseRelease(d.Name)
+	if anime := ctx.Titles.match(d.Name); anime != nil {
+		d.AnimeId = anime.Aid
+		d.AnimeTitle = anime.Canonical
+	}
+	if upload.Complete == upload.Length {
+		d.Completion = "100%"
+	} else {
+		d.Completion = fmt.Sprintf("%0.2f%%", upload.Completion*100)
+	}
+	if upload.Availability != nil {
+		d.Availability = fmt.Sprintf("%0.2f%%", *upload.Availability*100)
+	}
+	urls := ctx.urls(req)
+	d.Links.Details = urls.Abs("/upload/" + uploadId)
+	d.Links.Nzb = urls.Abs("/nzb/" + uploadId + "/" + urlPath(d.Name) + ".nzb")
+
+	posters := make(map[string]bool)
+	groups := make(map[string]bool)
+	for _, g := range upload.Group {
+		groups[g] = true
+	}
+	if upload.Poster != "" {
+		posters[upload.Poster] = true
+	}
+	var breakdown fileBreakdown
+	files := getFiles(ctx, uploadId)
+	d.Files = make([]detailFile, len(files))
+	for idx, f := range files {
+		df := detailFile{
+			Id:       f.Id,
+			Name:     f.Name,
+			Subject:  f.Subject,
+			Parts:    f.Parts,
+			Length:   f.Length,
+			Class:    classifyFile(f.Name),
+			Complete: f.Parts >= f.Length,
+			Bytes:    f.Bytes,
+			Size:     ByteSize(f.Bytes).String(),
+			Date:     time.Unix(f.Date, 0).UTC().Format("2006-01-02 15:04"),
+		}
+		if f.Length > 0 {
+			df.Completion = fmt.Sprintf("%0.0f%%", float64(f.Parts)/float64(f.Length)*100)
+		}
+		if df.Class == FILE_CONTENT && sampleRe.MatchString(f.Name) {
+			df.Sample = true
+			df.Nzb = urls.Abs("/nzb/" + uploadId + "/" + urlPath(strings.TrimSuffix(f.Name, ".")) + ".nzb?files=" + f.Id)
+		}
+		d.Files[idx] = df
+		posters[f.Poster] = true
+		for _, g := range f.Groups {
+			groups[g] = true
+		}
+		breakdown.add(f.Name, f.Bytes)
+	}
+	sort.Sort(detailFiles(d.Files))
+	d.Samples = make([]detailFile, 0, 1)
+	for _, f := range d.Files {
+		if f.Sample {
+			d.Samples = append(d.Samples, f)
+		}
+	}
+	d.Nfo = uploadNfo(ctx, uploadId, files)
+	d.ContentBytes = breakdown.ContentBytes
+	d.ContentSize = ByteSize(breakdown.ContentBytes).String()
+	d.Par2 = par2Totals{
+		IndexFiles: breakdown.Par2Index,
+		Volumes:    breakdown.Par2Volumes,
+		Blocks:     breakdown.Par2Blocks,
+		Bytes:      breakdown.RecoveryBytes,
+		Size:       ByteSize(breakdown.RecoveryBytes).String(),
+	}
+	d.Posters = sortedKeys(posters)
+	d.Groups = sortedKeys(groups)
+	d.Related = findRelated(ctx, urls, uploadId, upload)
+
+	if wantsJson(req) {
+		writeJson(res, 200, d)
+		return
+	}
+	res.Header().Set("Content-Type", "text/html")
+	renderTemplate(res, "upload.html", struct {
+		uploadDetail
+		Base    string
+		UrlPath func(string) string
+	}{d, urls.Prefix, urlPath})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// urlBuilder makes links from the public url of the site, which may put
+// every route under a path prefix.
+type urlBuilder struct {
+	Scheme string
+	Host   string
+	// Path prefix of every route, without a trailing slash.
+	Prefix string
+
+	configured bool
+}
+
+func parsePublicUrl(s string) (*urlBuilder, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("public url must be an absolute http or https url")
+	}
+	return &urlBuilder{
+		Scheme:     u.Scheme,
+		Host:       u.Host,
+		Prefix:     strings.TrimSuffix(u.Path, "/"),
+		configured: true,
+	}, nil
+}
+
+// Path returns the path of a route, for links within the site.
+func (u *urlBuilder) Path(path string) string {
+	return u.Prefix + path
+}
+
+// Abs returns the absolute url of a route.
+func (u *urlBuilder) Abs(path string) string {
+	return u.Scheme + "://" + u.Host + u.Prefix + path
+}
+
+// urls returns the links of a request, made from the public url if there
+// is one and from the address the request was made to otherwise.
+func (ctx *context) urls(req *http.Request) *urlBuilder {
+	if ctx.Urls.configured || req == nil {
+		return ctx.Urls
+	}
+	return &urlBuilder{
+		Scheme: ctx.Proxies.scheme(req),
+		Host:   ctx.Proxies.host(req),
+	}
+}
+
+// mountAt serves h under prefix. Requests without the prefix, from
+// proxies that strip it themselves, are served as is.
+func mountAt(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	stripped := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == prefix:
+			target := prefix + "/"
+			if req.URL.RawQuery != "" {
+				target += "?" + req.URL.RawQuery
+			}
+			http.Redirect(res, req, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(req.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(res, req)
+		default:
+			h.ServeHTTP(res, req)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+// Completes search boxes with a data-suggest url to the titles, release
+// groups and posters it suggests.
+$(function() {
+	$("input[data-suggest]").each(function() {
+		var input = $(this);
+		var url = input.data("suggest");
+		var menu = $("<ul class=\"dropdown-menu suggest-menu\"></ul>").insertAfter(input);
+		var timer = null;
+
+		input.attr("autocomplete", "off");
+
+		function hide() {
+			menu.hide().empty();
+		}
+		function choose(item) {
+			input.val(item.data("query"));
+			hide();
+			input.closest("form").submit();
+		}
+		function render(data) {
+			// Typing on may have made this answer stale.
+			if (data.query !== input.val() || data.suggestions.length == 0) {
+				if (data.query === input.val()) {
+					hide();
+				}
+				return;
+			}
+			menu.empty();
+			$.each(data.suggestions, function(i, s) {
+				var link = $("<a href=\"#\"></a>").text(s.value).data("query", s.query);
+				var label = $("<span class=\"label label-default pull-right\"></span>").text(s.type);
+				if (s.uploads > 0) {
+					label.text(s.type + " · " + s.uploads);
+				}
+				$("<li></li>").append(link.prepend(label)).appendTo(menu);
+			});
+			menu.show();
+		}
+
+		input.on("input", function() {
+			clearTimeout(timer);
+			var q = input.val();
+			if ($.trim(q).length < 2) {
+				hide();
+				return;
+			}
+			timer = setTimeout(function() {
+				$.getJSON(url, {q: q}, render);
+			}, 150);
+		});
+		input.on("keydown", function(event) {
+			if (!menu.is(":visible")) {
+				return;
+			}
+			var items = menu.find("a");
+			var active = items.index(menu.find("li.active a"));
+			switch (event.which) {
+			case 38: // up
+			case 40: // down
+				active += event.which == 40 ? 1 : -1;
+				active = (active + items.length) % items.length;
+				menu.find("li").removeClass("active").eq(active).addClass("active");
+				return false;
+			case 13: // enter
+				if (active >= 0) {
+					choose(items.eq(active));
+					return false;
+				}
+				break;
+			case 27: // escape
+				hide();
+				return false;
+			}
+		});
+		input.on("blur", function() {
+			// Let a click on the menu land first.
+			setTimeout(hide, 200);
+		});
+		menu.on("mousedown", "a", function(event) {
+			event.preventDefault();
+			choose($(this));
+		});
+	});
+});